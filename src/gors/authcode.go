@@ -0,0 +1,164 @@
+package gors
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+	"libs/uniuri"
+)
+
+/* ------------------------------------ Authorization Code Flow ----------------------------- */
+
+// With -auth-code-flow apps (like native sync clients) can request response_type=code
+// instead of a token. They must use PKCE (RFC 7636) with the S256 method and exchange the code
+// together with the code verifier for a token at TOKEN_PATH. Codes can be used only once.
+
+var TOKEN_PATH = GORS_PATH + "/token"
+
+const AUTHORIZATION_CODE_LIFETIME = time.Minute
+
+const PKCE_METHOD = "S256"
+
+// Webfinger properties of the authorization code flow
+const (
+	OAUTH_CODE_GRANT_PROPERTY     = "http://tools.ietf.org/html/rfc6749#section-4.1"
+	OAUTH_TOKEN_ENDPOINT_PROPERTY = "http://tools.ietf.org/html/rfc6749#section-3.2"
+	PKCE_PROPERTY                 = "http://tools.ietf.org/html/rfc7636"
+)
+
+// code challenges and verifiers consist of 43 to 128 unreserved characters
+var PKCE_VALUE_PATTERN = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+type authorizationCode struct {
+	authorization Authorization
+	redirectUri   string
+	codeChallenge string
+	expires       time.Time
+}
+
+// by hash of the code, like the tokens
+var authorizationCodes = make(map[string]*authorizationCode)
+var authorizationCodesMutex sync.Mutex
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+}
+
+func addAuthCodeFlowProperties(properties map[string]interface{}, baseURL string, username string) {
+	if !authCodeFlow {
+		return
+	}
+	properties[OAUTH_CODE_GRANT_PROPERTY] = baseURL + AUTH_PATH + username
+	properties[OAUTH_TOKEN_ENDPOINT_PROPERTY] = baseURL + TOKEN_PATH
+	properties[PKCE_PROPERTY] = PKCE_METHOD
+}
+
+// validateCodeChallenge returns the PKCE code challenge of a code request ("" for the implicit flow).
+func validateCodeChallenge(query url.Values, responseType string) (string, error) {
+	if responseType != "code" {
+		return "", nil
+	}
+	codeChallenge, _ := singleParameter(query, "code_challenge")
+	if !PKCE_VALUE_PATTERN.MatchString(codeChallenge) {
+		return "", errors.New("Missing or invalid code_challenge")
+	}
+	if method, _ := singleParameter(query, "code_challenge_method"); method != PKCE_METHOD {
+		return "", errors.New("Unsupported code_challenge_method")
+	}
+	return codeChallenge, nil
+}
+
+func newAuthorizationCode(authorization Authorization, redirectUri string, codeChallenge string) string {
+	code := uniuri.NewLen(32)
+	authorizationCodesMutex.Lock()
+	defer authorizationCodesMutex.Unlock()
+	now := time.Now()
+	for oldCode, authCode := range authorizationCodes {
+		if now.After(authCode.expires) {
+			delete(authorizationCodes, oldCode)
+		}
+	}
+	authorizationCodes[hashToken(code)] = &authorizationCode{authorization, redirectUri, codeChallenge, now.Add(AUTHORIZATION_CODE_LIFETIME)}
+	return code
+}
+
+// takeAuthorizationCode returns the authorization code and removes it, so it can't be used again.
+func takeAuthorizationCode(code string) *authorizationCode {
+	authorizationCodesMutex.Lock()
+	defer authorizationCodesMutex.Unlock()
+	authCode := authorizationCodes[hashToken(code)]
+	delete(authorizationCodes, hashToken(code))
+	if authCode == nil || time.Now().After(authCode.expires) {
+		return nil
+	}
+	return authCode
+}
+
+func revokeAuthorizationCodes(username string) {
+	authorizationCodesMutex.Lock()
+	defer authorizationCodesMutex.Unlock()
+	for code, authCode := range authorizationCodes {
+		if authCode.authorization.username == username {
+			delete(authorizationCodes, code)
+		}
+	}
+}
+
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	w.Header().Set("access-control-allow-methods", "POST")
+
+	if (r.Method == "OPTIONS") {
+		return;
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	r.ParseForm()
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeTokenError(w, "unsupported_grant_type")
+		return
+	}
+	code, _ := singleParameter(r.PostForm, "code")
+	authCode := takeAuthorizationCode(code)
+	if authCode == nil ||
+			r.PostForm.Get("redirect_uri") != authCode.redirectUri ||
+			r.PostForm.Get("client_id") != authCode.authorization.clientId ||
+			!isCodeVerifierValid(r.PostForm.Get("code_verifier"), authCode.codeChallenge) {
+		writeTokenError(w, "invalid_grant")
+		return
+	}
+
+	authorization := newAuthorization(authCode.authorization.username, authCode.authorization.clientId, authCode.authorization.scopes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokenResponse{authorization.bearerToken, "bearer", formatScopes(authorization.scopes)})
+}
+
+func isCodeVerifierValid(codeVerifier string, codeChallenge string) bool {
+	if !PKCE_VALUE_PATTERN.MatchString(codeVerifier) {
+		return false
+	}
+	hash := sha256.Sum256([]byte(codeVerifier))
+	expectedChallenge := base64.RawURLEncoding.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(expectedChallenge), []byte(codeChallenge)) == 1
+}
+
+// writeTokenError writes an error response of the token endpoint (http://tools.ietf.org/html/rfc6749#section-5.2).
+func writeTokenError(w http.ResponseWriter, errorCode string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(map[string]string{"error": errorCode})
+}
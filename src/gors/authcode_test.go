@@ -0,0 +1,176 @@
+package gors
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"libs/assrt"
+)
+
+const CODE_VERIFIER = "dBjftJeZ4CVP-mJ0cKbabcdefghijklmnopqrstuvwxyz0123456789"
+
+func codeChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func withAuthCodeFlow(t *testing.T) func() {
+	done := withAuthUser1(t)
+	authCodeFlow = true
+	return func() {
+		done()
+		authCodeFlow = false
+	}
+}
+
+func codeRequestQuery(challenge string) string {
+	return url.Values{
+		"redirect_uri": {"http://127.0.0.1:8000/callback?app=sync"},
+		"client_id": {"http://127.0.0.1:8000"},
+		"scope": {"module:rw"},
+		"response_type": {"code"},
+		"code_challenge": {challenge},
+		"code_challenge_method": {PKCE_METHOD},
+		"state": {"42"},
+	}.Encode()
+}
+
+func requestToken(form url.Values) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", TOKEN_PATH, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handleToken(w, r)
+	return w
+}
+
+func tokenForm(code string, verifier string) url.Values {
+	return url.Values{
+		"grant_type": {"authorization_code"},
+		"code": {code},
+		"redirect_uri": {"http://127.0.0.1:8000/callback?app=sync"},
+		"client_id": {"http://127.0.0.1:8000"},
+		"code_verifier": {verifier},
+	}
+}
+
+func requestCode(assert *assrt.Assert) string {
+	w := auth("POST", AUTH_PATH + "user1?" + codeRequestQuery(codeChallenge(CODE_VERIFIER)), "password")
+	assert.MustEqual(303, w.Code)
+	location, _ := url.Parse(w.Header().Get("Location"))
+	assert.Equal("/callback", location.Path)
+	assert.Equal("sync", location.Query().Get("app"))
+	assert.Equal("42", location.Query().Get("state"))
+	assert.Equal("", location.Fragment)
+	return location.Query().Get("code")
+}
+
+func TestAuthCodeFlow(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthCodeFlow(t)
+	defer done()
+
+	code := requestCode(assert)
+	assert.MustTrue(code != "")
+
+	w := requestToken(tokenForm(code, CODE_VERIFIER))
+	assert.MustEqual(200, w.Code)
+	assert.Equal("application/json", w.Header().Get("Content-Type"))
+	assert.Equal("no-store", w.Header().Get("Cache-Control"))
+	var response tokenResponse
+	assert.MustNil(json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal("bearer", response.TokenType)
+	assert.Equal("module:rw", response.Scope)
+	authorization := lookupAuthorization(response.AccessToken)
+	assert.MustNotNil(authorization)
+	assert.Equal("user1", authorization.username)
+	assert.Equal("http://127.0.0.1:8000", authorization.clientId)
+
+	// codes can be used only once
+	w = requestToken(tokenForm(code, CODE_VERIFIER))
+	assert.Equal(400, w.Code)
+	assert.True(strings.Contains(w.Body.String(), "invalid_grant"))
+}
+
+func TestAuthCodeFlowInvalidTokenRequests(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthCodeFlow(t)
+	defer done()
+
+	for _, test := range []struct {
+		name   string
+		modify func(url.Values)
+		error  string
+	}{
+		{"wrong grant type", func(form url.Values) { form.Set("grant_type", "password") }, "unsupported_grant_type"},
+		{"unknown code", func(form url.Values) { form.Set("code", "unknown") }, "invalid_grant"},
+		{"missing verifier", func(form url.Values) { form.Del("code_verifier") }, "invalid_grant"},
+		{"wrong verifier", func(form url.Values) { form.Set("code_verifier", CODE_VERIFIER + "x") }, "invalid_grant"},
+		{"short verifier", func(form url.Values) { form.Set("code_verifier", "short") }, "invalid_grant"},
+		{"other redirect_uri", func(form url.Values) { form.Set("redirect_uri", "http://127.0.0.1:8000/other") }, "invalid_grant"},
+		{"other client_id", func(form url.Values) { form.Set("client_id", "http://127.0.0.1:9000") }, "invalid_grant"},
+	} {
+		form := tokenForm(requestCode(assert), CODE_VERIFIER)
+		test.modify(form)
+		w := requestToken(form)
+		assert.Equal(400, w.Code, test.name)
+		assert.True(strings.Contains(w.Body.String(), test.error), test.name)
+	}
+
+	code := requestCode(assert)
+	authorizationCodes[hashToken(code)].expires = time.Now().Add(-time.Second)
+	w := requestToken(tokenForm(code, CODE_VERIFIER))
+	assert.Equal(400, w.Code)
+
+	r, _ := http.NewRequest("GET", TOKEN_PATH, nil)
+	w = httptest.NewRecorder()
+	handleToken(w, r)
+	assert.Equal(405, w.Code)
+}
+
+func TestAuthCodeRequestErrors(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthCodeFlow(t)
+	defer done()
+
+	for _, query := range []string{
+		codeRequestQuery(""),
+		codeRequestQuery("too-short"),
+		strings.Replace(codeRequestQuery(codeChallenge(CODE_VERIFIER)), "code_challenge_method=S256", "code_challenge_method=plain", 1),
+		strings.Replace(codeRequestQuery(codeChallenge(CODE_VERIFIER)), "&code_challenge_method=S256", "", 1),
+	} {
+		w := auth("GET", AUTH_PATH + "user1?" + query, "")
+		assert.Equal(302, w.Code, query)
+		assert.Equal("http://127.0.0.1:8000/callback?app=sync&error=invalid_request&state=42", w.Header().Get("Location"), query)
+	}
+
+	authCodeFlow = false
+	w := auth("GET", AUTH_PATH + "user1?" + codeRequestQuery(codeChallenge(CODE_VERIFIER)), "")
+	assert.Equal("http://127.0.0.1:8000/callback?app=sync#error=unsupported_response_type&state=42", w.Header().Get("Location"))
+}
+
+func TestWebfingerWithAuthCodeFlow(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthCodeFlow(t)
+	defer done()
+	specVersion = "draft-dejong-remotestorage-02"
+	defer func() { specVersion = "" }()
+
+	_, jrd := webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40example.com")
+	assert.MustEqual(2, len(jrd.Links))
+	for _, link := range jrd.Links {
+		assert.Equal("http://example.com/gors/auth/user1", link.Properties[OAUTH_CODE_GRANT_PROPERTY])
+		assert.Equal("http://example.com/gors/token", link.Properties[OAUTH_TOKEN_ENDPOINT_PROPERTY])
+		assert.Equal(PKCE_METHOD, link.Properties[PKCE_PROPERTY])
+	}
+
+	authCodeFlow = false
+	_, jrd = webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40example.com")
+	_, isAdvertised := jrd.Links[0].Properties[OAUTH_CODE_GRANT_PROPERTY]
+	assert.True(!isAdvertised)
+}
@@ -0,0 +1,94 @@
+package gors
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* ------------------------------------ Authenticators ----------------------------- */
+
+// An Authenticator checks the passwords of users. The storage of a user is always
+// found by the username (see getUserDataPath), no matter which authenticator is used.
+type Authenticator interface {
+	// Authenticate returns an error, if the password couldn't be checked.
+	Authenticate(username string, password string) (bool, error)
+	// UserExists checks if the user might log in, without a password.
+	UserExists(username string) bool
+}
+
+const (
+	FILE_AUTHENTICATOR     = "file"
+	LDAP_AUTHENTICATOR     = "ldap"
+	HTPASSWD_AUTHENTICATOR = "htpasswd"
+	OWNCLOUD_AUTHENTICATOR = "owncloud"
+)
+
+var authenticator Authenticator = passwordFileAuthenticator{}
+
+func userExists(username string) bool {
+	return isValidUsername(username) && authenticator.UserExists(username)
+}
+
+// canLogIn checks if the login form is shown to the user. Users of the directory (LDAP) can log in
+// before they have a storage, which is created at their first login (see checkLogin).
+func canLogIn(username string) bool {
+	if userExists(username) {
+		return true
+	}
+	_, isLDAPAuthenticator := authenticator.(ldapAuthenticator)
+	return isLDAPAuthenticator && isValidUsername(username)
+}
+
+// ensureUserStorage creates the storage of a user, who logged in for the first time.
+func ensureUserStorage(username string) {
+	dataDir := filepath.Clean(getUserDataPath(username))
+	if existData, _ := exists(dataDir); existData {
+		return
+	}
+	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
+		fmt.Println("Error", err)
+		return
+	}
+	for dir := dataDir; dir != filepath.Clean(dataPath); dir = filepath.Dir(dir) {
+		chownIfNeeded(dir, username)
+	}
+}
+
+func ensureUserGorsDir(username string) {
+	gorsDir := userGorsDir(username)
+	if existGorsDir, _ := exists(gorsDir); existGorsDir {
+		return
+	}
+	if err := os.MkdirAll(gorsDir, os.ModePerm); err != nil {
+		fmt.Println("Error", err)
+		return
+	}
+	chownIfNeeded(gorsDir, username)
+}
+
+/* ---- Password Files ---- */
+
+const PASSWORD_FILE_NAME = "password-sha512.txt"
+
+// passwordFileAuthenticator checks the SHA-512 hash in the .gors folder of the user.
+type passwordFileAuthenticator struct{}
+
+func (passwordFileAuthenticator) Authenticate(username string, password string) (bool, error) {
+	passwordFileBuf, err := ioutil.ReadFile(userGorsDir(username) + PASSWORD_FILE_NAME)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	expectedPasswordSha512 := strings.Trim(string(passwordFileBuf), " \n")
+	return subtle.ConstantTimeCompare([]byte(expectedPasswordSha512), []byte(sha512Sum(password))) == 1, nil
+}
+
+func (passwordFileAuthenticator) UserExists(username string) bool {
+	existUser, _ := exists(userGorsDir(username))
+	return existUser
+}
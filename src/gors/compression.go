@@ -0,0 +1,126 @@
+package gors
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/* ------------------------------------ Compression ----------------------------- */
+
+const GZIP_COMPRESSION = "gzip"
+
+// Meta keys of compressed documents
+const (
+	META_ENCODING = "encoding"
+	META_SIZE     = "size"
+)
+
+// Documents smaller than this are not worth compressing.
+const MIN_COMPRESSION_SIZE = 256
+
+// compressingStorage stores compressible documents compressed in the wrapped storage.
+// Opened documents stay compressed and are marked with ContentEncoding, so they can be
+// served as they are to clients accepting the encoding (see handleGetFile).
+// Without an encoding new documents are stored as they are, but compressed ones can still be read.
+type compressingStorage struct {
+	Storage
+	encoding string
+}
+
+func (s compressingStorage) Open(username string, path string) (Document, *Item, error) {
+	doc, item, err := s.Storage.Open(username, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if encoding := item.Meta[META_ENCODING]; encoding != "" {
+		item.ContentEncoding = encoding
+		item.Size, _ = strconv.ParseInt(item.Meta[META_SIZE], 10, 64)
+	}
+	return doc, item, nil
+}
+
+func (s compressingStorage) Put(username string, path string, body io.Reader, meta *Item) (*Item, error) {
+	if s.encoding == "" || !isCompressible(meta.ContentType) {
+		return s.Storage.Put(username, path, body, meta)
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < MIN_COMPRESSION_SIZE {
+		return s.Storage.Put(username, path, bytes.NewReader(content), meta)
+	}
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(content)
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	if compressed.Len() >= len(content) {
+		return s.Storage.Put(username, path, bytes.NewReader(content), meta)
+	}
+	compressedMeta := *meta
+	compressedMeta.Meta = map[string]string{}
+	for key, value := range meta.Meta {
+		compressedMeta.Meta[key] = value
+	}
+	compressedMeta.Meta[META_ENCODING] = s.encoding
+	compressedMeta.Meta[META_SIZE] = strconv.Itoa(len(content))
+	return s.Storage.Put(username, path, &compressed, &compressedMeta)
+}
+
+func isCompressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "xml") ||
+		strings.Contains(contentType, "javascript")
+}
+
+// acceptsEncoding checks the Accept-Encoding header of the request, where q=0 means "not acceptable".
+// The encoding itself takes precedence over * (https://tools.ietf.org/html/rfc7231#section-5.3.4).
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	acceptsAny := false
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(accepted, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != encoding && name != "*" {
+			continue
+		}
+		isAcceptable := true
+		for _, parameter := range parts[1:] {
+			parameter = strings.Replace(parameter, " ", "", -1)
+			if strings.HasPrefix(parameter, "q=") {
+				if q, err := strconv.ParseFloat(parameter[2:], 64); err == nil && q == 0 {
+					isAcceptable = false
+				}
+			}
+		}
+		if name == encoding {
+			return isAcceptable
+		}
+		acceptsAny = isAcceptable
+	}
+	return acceptsAny
+}
+
+func decodeDocument(doc io.Reader, encoding string) (io.ReadSeeker, error) {
+	if encoding != GZIP_COMPRESSION {
+		return nil, errors.New("Unknown content encoding: " + encoding)
+	}
+	gzipReader, err := gzip.NewReader(doc)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(content), nil
+}
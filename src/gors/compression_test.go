@@ -0,0 +1,131 @@
+package gors
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"libs/assrt"
+)
+
+var compressibleJson = `{"items":[` + strings.Repeat(`{"name":"drink","price":1},`, 50) + `{}]}`
+
+func getWithAcceptEncoding(url string, acceptEncoding string, token string) *httptest.ResponseRecorder {
+	r := requestWithToken("GET", url, "", token)
+	r.Header.Set("Accept-Encoding", acceptEncoding)
+	w := httptest.NewRecorder()
+	handleStorage(w, r)
+	return w
+}
+
+func TestCompressingStorage(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withTempStorage(t)
+	defer done()
+	storage = compressingStorage{fsStorage{}, GZIP_COMPRESSION}
+	defer func() { storage = fsStorage{} }()
+
+	r := requestWithToken("PUT", STORAGE_PATH + "user1/module/drinks.json", compressibleJson, "fs-token")
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handleStorage(w, r)
+	assert.Equal(200, w.Code)
+	etag := w.Header().Get("ETag")
+
+	stored, _ := ioutil.ReadFile(getUserDataPath("user1") + "/module/drinks.json")
+	assert.True(len(stored) < len(compressibleJson))
+
+	w = getWithAcceptEncoding(STORAGE_PATH + "user1/module/drinks.json", "gzip, deflate", "fs-token")
+	assert.Equal("gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(etag, w.Header().Get("ETag"))
+	gzipReader, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+	assert.MustNil(err)
+	uncompressed, _ := ioutil.ReadAll(gzipReader)
+	assert.Equal(compressibleJson, string(uncompressed))
+
+	w = getWithAcceptEncoding(STORAGE_PATH + "user1/module/drinks.json", "gzip;q=0", "fs-token")
+	assert.Equal("", w.Header().Get("Content-Encoding"))
+	assert.Equal("application/json", w.Header().Get("Content-Type"))
+	assert.Equal(etag, w.Header().Get("ETag"))
+	assert.Equal(compressibleJson, w.Body.String())
+
+	// small and incompressible documents are stored as they are
+	r = requestWithToken("PUT", STORAGE_PATH + "user1/module/drinks.json", "{}", "fs-token")
+	r.Header.Set("Content-Type", "application/json")
+	handleStorage(httptest.NewRecorder(), r)
+	w = getWithAcceptEncoding(STORAGE_PATH + "user1/module/drinks.json", "gzip", "fs-token")
+	assert.Equal("", w.Header().Get("Content-Encoding"))
+	assert.Equal("{}", w.Body.String())
+
+	w = httptest.NewRecorder()
+	handleStorage(w, requestWithToken("GET", STORAGE_PATH + "user1/module/", "", "fs-token"))
+	assert.Equal("{\n\"drinks.json\":\"" + strings.Trim(etag, "\"") + "\"\n}\n", w.Body.String())
+}
+
+func TestCompressingStorageWithS3AndEncryption(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withEncryption(t)
+	defer done()
+	fake, s3Done := withS3Storage(t)
+	defer s3Done()
+	storage = compressingStorage{encryptingStorage{storage}, GZIP_COMPRESSION}
+
+	w := storageRequest("PUT", "/module/drinks.json", compressibleJson, map[string]string{"Content-Type": "application/json"})
+	assert.Equal(200, w.Code)
+	object := fake.objects["user1/module/drinks.json"]
+	assert.Equal("gzip", object.meta.Get("X-Amz-Meta-Encoding"))
+	assert.True(isEncryptedDocument(object.body))
+
+	w = storageRequest("GET", "/module/drinks.json", "", nil)
+	assert.Equal(compressibleJson, w.Body.String())
+}
+
+func TestCompressedDocumentsWithoutCompression(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withTempStorage(t)
+	defer done()
+	defer func() { storage = fsStorage{} }()
+
+	storage = compressingStorage{fsStorage{}, GZIP_COMPRESSION}
+	r := requestWithToken("PUT", STORAGE_PATH + "user1/module/drinks.json", compressibleJson, "fs-token")
+	r.Header.Set("Content-Type", "application/json")
+	handleStorage(httptest.NewRecorder(), r)
+
+	// the server restarted without -compress
+	storage = compressingStorage{fsStorage{}, ""}
+	w := getWithAcceptEncoding(STORAGE_PATH + "user1/module/drinks.json", "", "fs-token")
+	assert.Equal(200, w.Code)
+	assert.Equal("", w.Header().Get("Content-Encoding"))
+	assert.Equal(compressibleJson, w.Body.String())
+
+	// new documents are stored uncompressed
+	r = requestWithToken("PUT", STORAGE_PATH + "user1/module/drinks.json", compressibleJson, "fs-token")
+	r.Header.Set("Content-Type", "application/json")
+	handleStorage(httptest.NewRecorder(), r)
+	stored, _ := ioutil.ReadFile(getUserDataPath("user1") + "/module/drinks.json")
+	assert.Equal(compressibleJson, string(stored))
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	for acceptEncoding, expected := range map[string]bool{
+		"": false,
+		"gzip": true,
+		"deflate, gzip;q=1.0, *;q=0.5": true,
+		"gzip;q=0": false,
+		"gzip; q=0.0": false,
+		"identity": false,
+		"*": true,
+		"*;q=0.5, gzip;q=0": false,
+		"gzip;q=0, *": false,
+		"*;q=0, gzip": true,
+		"GZIP": true,
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		assert.Equal(expected, acceptsEncoding(r, "gzip"), acceptEncoding)
+	}
+}
@@ -0,0 +1,273 @@
+package gors
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/* ------------------------------------ Encryption at Rest ----------------------------- */
+
+// Every user has an own random data key, which is stored in the .gors folder of the
+// user wrapped (encrypted) by a key derived from the server secret. The .gors folder is
+// always local, so with the S3 backend every server needs a copy of the data keys.
+// Documents are stored as ENCRYPTED_DOCUMENT_MAGIC + nonce + AES-256-GCM ciphertext.
+// Documents without the magic prefix are served as they are, so a storage can be
+// encrypted while it is in use.
+
+const ENCRYPTED_DOCUMENT_MAGIC = "GORSENC1"
+
+const DATA_KEY_FILE_NAME = "data-key.txt"
+
+// Temporary files of the encryption tool are hidden like meta files (see isMetaFile).
+const CRYPT_TEMP_FILE_NAME_PREFIX = ".gors-crypt-"
+
+var dataKeys = make(map[string][]byte)
+var dataKeysMutex sync.Mutex
+
+// encryptingStorage encrypts documents before they are put into the wrapped storage
+// and decrypts them when they are opened.
+type encryptingStorage struct {
+	Storage
+}
+
+func (s encryptingStorage) Open(username string, path string) (Document, *Item, error) {
+	doc, item, err := s.Storage.Open(username, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer doc.Close()
+	content, err := ioutil.ReadAll(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := decryptDocument(username, content)
+	if err != nil {
+		return nil, nil, err
+	}
+	item.Size = int64(len(plaintext))
+	return nopCloser{bytes.NewReader(plaintext)}, item, nil
+}
+
+func (s encryptingStorage) Put(username string, path string, body io.Reader, meta *Item) (*Item, error) {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := encryptDocument(username, content)
+	if err != nil {
+		return nil, err
+	}
+	return s.Storage.Put(username, path, bytes.NewReader(ciphertext), meta)
+}
+
+func isEncryptedDocument(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(ENCRYPTED_DOCUMENT_MAGIC))
+}
+
+func encryptDocument(username string, plaintext []byte) ([]byte, error) {
+	key, err := userDataKey(username)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(ENCRYPTED_DOCUMENT_MAGIC), sealed...), nil
+}
+
+func decryptDocument(username string, content []byte) ([]byte, error) {
+	if !isEncryptedDocument(content) {
+		return content, nil
+	}
+	key, err := userDataKey(username)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(key, content[len(ENCRYPTED_DOCUMENT_MAGIC):])
+}
+
+// userDataKey returns the unwrapped data key of the user and creates it on first use.
+func userDataKey(username string) ([]byte, error) {
+	dataKeysMutex.Lock()
+	defer dataKeysMutex.Unlock()
+
+	if key := dataKeys[username]; key != nil {
+		return key, nil
+	}
+
+	keyFilename := userGorsDir(username) + DATA_KEY_FILE_NAME
+	wrappingKey := userWrappingKey(username)
+	var key []byte
+	wrappedKey, err := ioutil.ReadFile(keyFilename)
+	if err == nil {
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(wrappedKey)))
+		if err != nil {
+			return nil, err
+		}
+		key, err = unseal(wrappingKey, sealed)
+		if err != nil {
+			return nil, errors.New("Can't unwrap data key of " + username + ". Wrong server secret?")
+		}
+	} else if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		sealed, err := seal(wrappingKey, key)
+		if err != nil {
+			return nil, err
+		}
+		os.MkdirAll(userGorsDir(username), os.ModePerm)
+		f, err := os.OpenFile(keyFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write([]byte(base64.StdEncoding.EncodeToString(sealed) + "\n"))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		chownIfNeeded(keyFilename, username)
+	} else {
+		return nil, err
+	}
+
+	dataKeys[username] = key
+	return key, nil
+}
+
+func userWrappingKey(username string) []byte {
+	return hmacSha256(serverSecret, "gors data key wrapping:" + username)
+}
+
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func unseal(key []byte, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("Encrypted data is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/* ------------------------------------ Encryption Tool ----------------------------- */
+
+// CryptStorage encrypts (or decrypts) all documents of all users in the storage directory in place.
+// Modification times of documents and folders are kept, so ETags don't change for clients.
+func CryptStorage(config Config, encrypt bool) error {
+	configure(config)
+	if len(serverSecret) == 0 {
+		return errors.New("Encryption needs a server secret")
+	}
+	if config.Backend == S3_BACKEND {
+		return errors.New("Only the fs storage backend can be encrypted in place")
+	}
+
+	users, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if !user.IsDir() {
+			continue
+		}
+		username := user.Name()
+		userStoragePath := getUserDataPath(username)
+		if existUserStorage, _ := exists(userStoragePath); !existUserStorage {
+			continue
+		}
+		count := 0
+		err := filepath.Walk(userStoragePath, func(filename string, fInfo os.FileInfo, err error) error {
+			if err != nil || fInfo.IsDir() {
+				return err
+			}
+			if strings.HasPrefix(fInfo.Name(), CRYPT_TEMP_FILE_NAME_PREFIX) {
+				// left over by an interrupted run
+				return os.Remove(filename)
+			}
+			if isMetaFile(fInfo.Name()) {
+				return nil
+			}
+			changed, err := cryptFile(username, filename, fInfo, encrypt)
+			if changed {
+				count++
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println(username + ":", count, "documents changed")
+	}
+	return nil
+}
+
+func cryptFile(username string, filename string, fInfo os.FileInfo, encrypt bool) (bool, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	if isEncryptedDocument(content) == encrypt {
+		return false, nil
+	}
+	var newContent []byte
+	if encrypt {
+		newContent, err = encryptDocument(username, content)
+	} else {
+		newContent, err = decryptDocument(username, content)
+	}
+	if err != nil {
+		return false, errors.New(filename + ": " + err.Error())
+	}
+
+	dir := filepath.Dir(filename)
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		return false, err
+	}
+	tempFilename := dir + "/" + CRYPT_TEMP_FILE_NAME_PREFIX + fInfo.Name()
+	if err := ioutil.WriteFile(tempFilename, newContent, fInfo.Mode()); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tempFilename, filename); err != nil {
+		os.Remove(tempFilename)
+		return false, err
+	}
+	chownIfNeeded(filename, username)
+	os.Chtimes(filename, fInfo.ModTime(), fInfo.ModTime())
+	os.Chtimes(dir, dirInfo.ModTime(), dirInfo.ModTime())
+	return true, nil
+}
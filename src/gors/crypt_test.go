@@ -0,0 +1,91 @@
+package gors
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"libs/assrt"
+)
+
+func withEncryption(t *testing.T) func() {
+	done := withTempStorage(t)
+	serverSecret = []byte("secret")
+	storage = encryptingStorage{fsStorage{}}
+	return func() {
+		done()
+		serverSecret = nil
+		storage = fsStorage{}
+		dataKeys = make(map[string][]byte)
+	}
+}
+
+func TestEncryptingStorage(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withEncryption(t)
+	defer done()
+
+	w := httptest.NewRecorder()
+	handleStorage(w, requestWithToken("PUT", STORAGE_PATH + "user1/module/file.txt", "secret text", "fs-token"))
+	assert.Equal(200, w.Code)
+	etag := w.Header().Get("ETag")
+
+	stored, _ := ioutil.ReadFile(getUserDataPath("user1") + "/module/file.txt")
+	assert.True(isEncryptedDocument(stored))
+	assert.True(!strings.Contains(string(stored), "secret text"))
+
+	// the key must survive a restart of the server
+	dataKeys = make(map[string][]byte)
+	w = httptest.NewRecorder()
+	handleStorage(w, requestWithToken("GET", STORAGE_PATH + "user1/module/file.txt", "", "fs-token"))
+	assert.Equal("secret text", w.Body.String())
+	assert.Equal(etag, w.Header().Get("ETag"))
+
+	dataKeys = make(map[string][]byte)
+	serverSecret = []byte("wrong secret")
+	_, _, err := storage.Open("user1", "/module/file.txt")
+	assert.NotNil(err)
+}
+
+func TestCryptStorage(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withEncryption(t)
+	defer done()
+
+	filename := getUserDataPath("user1") + "/module/file.txt"
+	os.MkdirAll(getUserDataPath("user1") + "/module", os.ModePerm)
+	ioutil.WriteFile(filename, []byte("plain text"), 0644)
+	fInfoBefore, _ := os.Stat(filename)
+	dirInfoBefore, _ := os.Stat(getUserDataPath("user1") + "/module")
+
+	secretFile := dataPath + "/secret.txt"
+	ioutil.WriteFile(secretFile, []byte("secret\n"), 0600)
+	config := Config{StorageDir: dataPath, StorageMode: HOME, SecretFile: secretFile}
+	assert.MustNil(CryptStorage(config, true))
+
+	stored, _ := ioutil.ReadFile(filename)
+	assert.True(isEncryptedDocument(stored))
+	fInfoAfter, _ := os.Stat(filename)
+	dirInfoAfter, _ := os.Stat(getUserDataPath("user1") + "/module")
+	assert.Equal(fInfoBefore.ModTime(), fInfoAfter.ModTime())
+	assert.Equal(dirInfoBefore.ModTime(), dirInfoAfter.ModTime())
+
+	// encrypting twice must not change anything
+	assert.MustNil(CryptStorage(config, true))
+	storedAgain, _ := ioutil.ReadFile(filename)
+	assert.Equal(stored, storedAgain)
+
+	assert.MustNil(CryptStorage(config, false))
+	stored, _ = ioutil.ReadFile(filename)
+	assert.Equal("plain text", string(stored))
+
+	// temporary files of an interrupted run are neither listed nor kept
+	leftover := getUserDataPath("user1") + "/module/" + CRYPT_TEMP_FILE_NAME_PREFIX + "file.txt"
+	ioutil.WriteFile(leftover, []byte("partly written"), 0644)
+	items, _ := fsStorage{}.List("user1", "/module/")
+	assert.Equal(1, len(items))
+	assert.MustNil(CryptStorage(config, true))
+	existLeftover, _ := exists(leftover)
+	assert.True(!existLeftover)
+}
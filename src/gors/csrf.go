@@ -0,0 +1,68 @@
+package gors
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+/* ------------------------------------ CSRF Protection ----------------------------- */
+
+// The forms of the auth page and the dashboard contain a CSRF token, which binds the request
+// (path and query) to a random cookie of the browser. A form posted from another site has neither.
+
+const CSRF_COOKIE_NAME = "gors_csrf"
+
+const CSRF_TOKEN_FIELD = "csrf_token"
+
+// Used to sign CSRF tokens, if there is no server secret.
+var csrfProcessKey = randomBytes(32)
+
+// csrfToken returns the CSRF token for the auth request and sets the CSRF cookie if needed.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(CSRF_COOKIE_NAME)
+	if err != nil || cookie.Value == "" {
+		cookie = &http.Cookie{
+			Name:     CSRF_COOKIE_NAME,
+			Value:    hex.EncodeToString(randomBytes(16)),
+			Path:     GORS_PATH + "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		}
+		http.SetCookie(w, cookie)
+	}
+	return signCsrfToken(cookie.Value, r)
+}
+
+func isCsrfTokenValid(r *http.Request) bool {
+	cookie, err := r.Cookie(CSRF_COOKIE_NAME)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return hmac.Equal([]byte(r.PostFormValue(CSRF_TOKEN_FIELD)), []byte(signCsrfToken(cookie.Value, r)))
+}
+
+func signCsrfToken(cookieValue string, r *http.Request) string {
+	key := csrfProcessKey
+	if len(serverSecret) > 0 {
+		key = hmacSha256(serverSecret, "gors csrf")
+	}
+	return hex.EncodeToString(hmacSha256(key, cookieValue + "\n" + r.URL.Path + "?" + r.URL.RawQuery))
+}
+
+// setFrameBustingHeaders prevents that pages are shown in frames of other sites (clickjacking).
+func setFrameBustingHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+}
+
+func randomBytes(n int) []byte {
+	bytes := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, bytes); err != nil {
+		panic(err)
+	}
+	return bytes
+}
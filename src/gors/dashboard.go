@@ -0,0 +1,120 @@
+package gors
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/* ------------------------------------ Dashboard ----------------------------- */
+
+// The dashboard is the page where users manage their account after logging in with their password.
+
+var DASHBOARD_PATH = GORS_PATH + "/dashboard/"
+
+const TOTP_ISSUER = "gors"
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Path[len(DASHBOARD_PATH):]
+	setFrameBustingHeaders(w)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !canLogIn(username) {
+		http.NotFound(w, r)
+		return
+	}
+	loggedIn := sessionUsername(r) == username
+	data := map[string]interface{} {
+		"username": username,
+	}
+
+	if r.Method == "POST" {
+		if !isCsrfTokenValid(r) {
+			renderAuthError(w, 403, "The form has expired. Please reload the page and try again.")
+			return
+		}
+		if !loggedIn {
+			loginError := checkLogin(username, r.PostFormValue("password"), r.PostFormValue("otp"))
+			if loginError == "" {
+				startSession(w, r, username)
+				http.Redirect(w, r, r.URL.Path, 303)
+				return
+			}
+			data["loginError"] = loginError
+		} else {
+			switch r.PostFormValue("action") {
+			case "logout":
+				endSession(w, r)
+				http.Redirect(w, r, r.URL.Path, 303)
+				return
+			case "enable-2fa":
+				secret := r.PostFormValue("secret")
+				recoveryCodes, err := enableTwoFactor(username, secret, r.PostFormValue("code"))
+				if err != nil {
+					data["error"] = err.Error()
+					data["totpSecret"] = secret
+				} else {
+					data["recoveryCodes"] = recoveryCodes
+				}
+			case "change-password":
+				if !isPasswordValid(username, r.PostFormValue("password")) {
+					data["error"] = "Wrong Password"
+				} else if err := changePassword(username, r.PostFormValue("newPassword"), r.PostFormValue("newPassword2"), r.PostFormValue("revoke") != ""); err != nil {
+					data["error"] = err.Error()
+				} else {
+					if r.PostFormValue("revoke") != "" {
+						signOutBrowsers(username, requestSessionId(r))
+					}
+					data["message"] = "Your password has been changed."
+				}
+			case "create-share":
+				days, err := strconv.Atoi(r.PostFormValue("days"))
+				if err != nil {
+					data["error"] = "Invalid expiry"
+					break
+				}
+				token, s, err := createShare(username, r.PostFormValue("path"), time.Duration(days) * 24 * time.Hour, r.PostFormValue("sharePassword"), DASHBOARD_CREATOR)
+				if err != nil {
+					data["error"] = err.Error()
+				} else {
+					data["newShareUrl"] = getBaseUrl(r) + shareUrlPath(username, token, s)
+				}
+			case "revoke-share":
+				if err := revokeShare(username, r.PostFormValue("id")); err != nil {
+					data["error"] = err.Error()
+				}
+			case "disable-2fa":
+				if isSecondFactorValid(username, r.PostFormValue("code")) {
+					if err := disableTwoFactor(username); err != nil {
+						data["error"] = err.Error()
+					}
+				} else {
+					data["error"] = "Wrong one-time code"
+				}
+			}
+		}
+	}
+
+	data["loggedIn"] = loggedIn
+	data["twoFactor"] = hasTwoFactor(username)
+	data["canChangePassword"] = canChangePassword()
+	data["minPasswordLength"] = minPasswordLength
+	if loggedIn && !hasTwoFactor(username) {
+		if data["totpSecret"] == nil {
+			data["totpSecret"] = newTotpSecret()
+		}
+		// html/template would reject the otpauth scheme
+		data["totpUri"] = template.URL(totpUri(TOTP_ISSUER, username, data["totpSecret"].(string)))
+	}
+	if loggedIn {
+		shares, err := listShares(r, username)
+		if err != nil {
+			fmt.Println("Error", err)
+		}
+		data["shares"] = shares
+	}
+	data["csrfToken"] = csrfToken(w, r)
+	renderTemplate(w, "dashboard.html", data)
+}
@@ -0,0 +1,96 @@
+package gors
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"libs/assrt"
+)
+
+var TOTP_SECRET_INPUT_PATTERN = regexp.MustCompile(`name="secret" value="([A-Z2-7=]+)"`)
+
+// postDashboard posts a form of the dashboard page like a browser and returns the page afterwards.
+func postDashboard(assert *assrt.Assert, form url.Values, cookies []*http.Cookie) (string, []*http.Cookie) {
+	w := getWithCookies(handleDashboard, DASHBOARD_PATH + "user1", cookies)
+	cookies = append(cookies, w.Result().Cookies()...)
+	match := CSRF_TOKEN_INPUT_PATTERN.FindStringSubmatch(w.Body.String())
+	assert.MustNotNil(match)
+	form.Set(CSRF_TOKEN_FIELD, match[1])
+	w = postForm(handleDashboard, DASHBOARD_PATH + "user1", form, cookies)
+	cookies = append(cookies, w.Result().Cookies()...)
+	if w.Code == 303 {
+		w = getWithCookies(handleDashboard, DASHBOARD_PATH + "user1", cookies)
+	}
+	return w.Body.String(), cookies
+}
+
+func TestDashboardLogin(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+
+	w := getWithCookies(handleDashboard, DASHBOARD_PATH + "user1", nil)
+	assert.Equal(200, w.Code)
+	assert.Equal("DENY", w.Header().Get("X-Frame-Options"))
+	assert.True(strings.Contains(w.Body.String(), `name="password"`))
+
+	page, _ := postDashboard(assert, url.Values{"password": {"wrong"}}, nil)
+	assert.True(strings.Contains(page, "Wrong Password"))
+
+	page, cookies := postDashboard(assert, url.Values{"password": {"password"}}, nil)
+	assert.True(strings.Contains(page, "Two-Factor Authentication"))
+
+	page, _ = postDashboard(assert, url.Values{"action": {"logout"}}, cookies)
+	assert.True(strings.Contains(page, `name="password"`))
+
+	for _, path := range []string{"unknown", "..", ""} {
+		w := getWithCookies(handleDashboard, DASHBOARD_PATH + path, nil)
+		assert.Equal(404, w.Code, path)
+	}
+}
+
+func TestDashboardTwoFactorEnrolment(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+
+	page, cookies := postDashboard(assert, url.Values{"password": {"password"}}, nil)
+	match := TOTP_SECRET_INPUT_PATTERN.FindStringSubmatch(page)
+	assert.MustNotNil(match)
+	secret := match[1]
+	assert.True(strings.Contains(page, "otpauth://totp/gors:user1?"))
+
+	page, cookies = postDashboard(assert, url.Values{"action": {"enable-2fa"}, "secret": {secret}, "code": {"000000"}}, cookies)
+	assert.True(strings.Contains(page, "Wrong one-time code"))
+	assert.True(!hasTwoFactor("user1"))
+
+	page, cookies = postDashboard(assert, url.Values{"action": {"enable-2fa"}, "secret": {secret}, "code": {currentTotp(secret)}}, cookies)
+	assert.True(strings.Contains(page, "recovery codes"))
+	assert.True(hasTwoFactor("user1"))
+	recoveryCode := regexp.MustCompile(`<code>([0-9a-f]{10})</code>`).FindStringSubmatch(page)
+	assert.MustNotNil(recoveryCode)
+
+	// the session alone isn't enough to replace the second factor
+	otherSecret := newTotpSecret()
+	page, cookies = postDashboard(assert, url.Values{"action": {"enable-2fa"}, "secret": {otherSecret}, "code": {currentTotp(otherSecret)}}, cookies)
+	assert.True(strings.Contains(page, "already enabled"))
+	settings, _ := readTwoFactorSettings("user1")
+	assert.Equal(secret, settings.Secret)
+
+	// a new login needs the second factor
+	page, _ = postDashboard(assert, url.Values{"password": {"password"}}, nil)
+	assert.True(strings.Contains(page, "Wrong one-time code"))
+	page, _ = postDashboard(assert, url.Values{"password": {"password"}, "otp": {recoveryCode[1]}}, nil)
+	assert.True(strings.Contains(page, `value="disable-2fa"`))
+
+	page, cookies = postDashboard(assert, url.Values{"action": {"disable-2fa"}, "code": {"000000"}}, cookies)
+	assert.True(strings.Contains(page, "Wrong one-time code"))
+	assert.True(hasTwoFactor("user1"))
+	settings, _ = readTwoFactorSettings("user1")
+	settings.LastStep = 0
+	writeTwoFactorSettings("user1", settings)
+	postDashboard(assert, url.Values{"action": {"disable-2fa"}, "code": {currentTotp(secret)}}, cookies)
+	assert.True(!hasTwoFactor("user1"))
+}
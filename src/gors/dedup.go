@@ -0,0 +1,328 @@
+package gors
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ------------------------------------ Deduplication ----------------------------- */
+
+// In dedup mode the body of every document is stored only once in a blob store,
+// which is shared by all users. The file of the document in the storage of a user
+// contains only the content hash, which is also kept in its meta data (META_BLOB).
+// Blobs are reference counted and removed when their last document is deleted.
+// The garbage collector repairs reference counts (e.g. after a crash) by counting
+// all documents, which blocks writes while it runs.
+// Blobs are owned by the server process, because they don't belong to a single user.
+// Without -dedup an existing blob store is still read (decodeOnly), so documents stored before
+// are served with their content. New documents are stored as they are then and release their old blobs.
+// Git history can't be used together with dedup, because it would only record the hashes.
+
+const META_BLOB = "blob"
+
+const BLOBS_DIR_NAME = ".gors-blobs"
+
+const BLOB_GC_INTERVAL = time.Hour
+
+type blobStore struct {
+	dir       string
+	// writers hold a read lock while they add or remove references, the garbage collector holds the write lock
+	gcLock    sync.RWMutex
+	refsMutex sync.Mutex
+	// writes to the same document are serialized from reading its old hash until the old blob is released,
+	// otherwise concurrent writes could release the old blob twice
+	pathLocks      map[string]*pathLock
+	pathLocksMutex sync.Mutex
+}
+
+type pathLock struct {
+	sync.Mutex
+	waiting int
+}
+
+type dedupStorage struct {
+	Storage
+	blobs      *blobStore
+	decodeOnly bool
+}
+
+func newBlobStore(dir string) *blobStore {
+	return &blobStore{dir: dir, pathLocks: make(map[string]*pathLock)}
+}
+
+// lockPath locks the document of the user and returns the function to unlock it.
+func (b *blobStore) lockPath(username string, path string) func() {
+	key := username + ":" + path
+	b.pathLocksMutex.Lock()
+	lock := b.pathLocks[key]
+	if lock == nil {
+		lock = &pathLock{}
+		b.pathLocks[key] = lock
+	}
+	lock.waiting++
+	b.pathLocksMutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		b.pathLocksMutex.Lock()
+		lock.waiting--
+		if lock.waiting == 0 {
+			delete(b.pathLocks, key)
+		}
+		b.pathLocksMutex.Unlock()
+	}
+}
+
+func (s dedupStorage) Open(username string, path string) (Document, *Item, error) {
+	doc, item, err := s.Storage.Open(username, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := item.Meta[META_BLOB]
+	if hash == "" {
+		return doc, item, nil
+	}
+	doc.Close()
+	blob, err := os.Open(s.blobs.blobFilename(hash))
+	if err != nil {
+		return nil, nil, err
+	}
+	if fInfo, err := blob.Stat(); err == nil {
+		item.Size = fInfo.Size()
+	}
+	return blob, item, nil
+}
+
+func (s dedupStorage) Put(username string, path string, body io.Reader, meta *Item) (*Item, error) {
+	s.blobs.gcLock.RLock()
+	defer s.blobs.gcLock.RUnlock()
+	defer s.blobs.lockPath(username, path)()
+
+	oldHash := s.blobHash(username, path)
+	if s.decodeOnly {
+		plainMeta := *meta
+		plainMeta.Meta = map[string]string{}
+		for key, value := range meta.Meta {
+			if key != META_BLOB {
+				plainMeta.Meta[key] = value
+			}
+		}
+		item, err := s.Storage.Put(username, path, body, &plainMeta)
+		if err == nil && oldHash != "" {
+			s.blobs.release(oldHash)
+		}
+		return item, err
+	}
+	hash, err := s.blobs.add(body)
+	if err != nil {
+		return nil, err
+	}
+	pointerMeta := *meta
+	pointerMeta.Meta = map[string]string{}
+	for key, value := range meta.Meta {
+		pointerMeta.Meta[key] = value
+	}
+	pointerMeta.Meta[META_BLOB] = hash
+	item, err := s.Storage.Put(username, path, strings.NewReader(hash), &pointerMeta)
+	if err != nil {
+		s.blobs.release(hash)
+		return nil, err
+	}
+	if oldHash != "" {
+		s.blobs.release(oldHash)
+	}
+	return item, nil
+}
+
+func (s dedupStorage) Delete(username string, path string) error {
+	s.blobs.gcLock.RLock()
+	defer s.blobs.gcLock.RUnlock()
+	defer s.blobs.lockPath(username, path)()
+
+	hash := s.blobHash(username, path)
+	if err := s.Storage.Delete(username, path); err != nil {
+		return err
+	}
+	if hash != "" {
+		s.blobs.release(hash)
+	}
+	return nil
+}
+
+func (s dedupStorage) blobHash(username string, path string) string {
+	doc, item, err := s.Storage.Open(username, path)
+	if err != nil {
+		return ""
+	}
+	doc.Close()
+	return item.Meta[META_BLOB]
+}
+
+func (b *blobStore) blobFilename(hash string) string {
+	return b.dir + "/" + hash[:2] + "/" + hash
+}
+
+func refsFilename(blobFilename string) string {
+	return blobFilename + ".refs"
+}
+
+// add stores the body as blob (if it's not already stored) and adds a reference to it.
+func (b *blobStore) add(body io.Reader) (string, error) {
+	os.MkdirAll(b.dir, os.ModePerm)
+	temp, err := ioutil.TempFile(b.dir, ".new-blob-")
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(temp, hasher), body)
+	temp.Close()
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	filename := b.blobFilename(hash)
+
+	b.refsMutex.Lock()
+	defer b.refsMutex.Unlock()
+	refs := readRefs(filename)
+	if existBlob, _ := exists(filename); existBlob {
+		os.Remove(temp.Name())
+	} else {
+		os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+		if err := os.Rename(temp.Name(), filename); err != nil {
+			os.Remove(temp.Name())
+			return "", err
+		}
+		refs = 0
+	}
+	return hash, writeRefs(filename, refs + 1)
+}
+
+// release removes a reference to the blob and removes the blob with its last reference.
+func (b *blobStore) release(hash string) {
+	filename := b.blobFilename(hash)
+	b.refsMutex.Lock()
+	defer b.refsMutex.Unlock()
+	refs := readRefs(filename) - 1
+	if refs <= 0 {
+		os.Remove(filename)
+		os.Remove(refsFilename(filename))
+		os.Remove(filepath.Dir(filename))
+		return
+	}
+	if err := writeRefs(filename, refs); err != nil {
+		fmt.Println("Error while releasing blob:", err)
+	}
+}
+
+func readRefs(blobFilename string) int {
+	content, err := ioutil.ReadFile(refsFilename(blobFilename))
+	if err != nil {
+		return 0
+	}
+	refs, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+	return refs
+}
+
+func writeRefs(blobFilename string, refs int) error {
+	return ioutil.WriteFile(refsFilename(blobFilename), []byte(strconv.Itoa(refs) + "\n"), 0644)
+}
+
+/* ------------------------------------ Blob Garbage Collector ----------------------------- */
+
+func (b *blobStore) collectGarbagePeriodically() {
+	for {
+		if removed, err := b.collectGarbage(); err != nil {
+			fmt.Println("Error while collecting garbage blobs:", err)
+		} else if removed > 0 {
+			fmt.Println("Removed", removed, "garbage blobs")
+		}
+		time.Sleep(BLOB_GC_INTERVAL)
+	}
+}
+
+// collectGarbage counts the references to every blob from the documents of all users,
+// fixes the stored reference counts and removes blobs without references.
+func (b *blobStore) collectGarbage() (int, error) {
+	b.gcLock.Lock()
+	defer b.gcLock.Unlock()
+
+	refsByHash, err := countBlobReferences()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	err = filepath.Walk(b.dir, func(filename string, fInfo os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// the refs file of a removed blob or the blob store itself
+			return nil
+		} else if err != nil || fInfo.IsDir() || strings.HasSuffix(filename, ".refs") {
+			return err
+		}
+		if strings.HasPrefix(fInfo.Name(), ".new-blob-") {
+			// left over by an interrupted write
+			return os.Remove(filename)
+		}
+		refs := refsByHash[fInfo.Name()]
+		if refs == 0 {
+			removed++
+			os.Remove(refsFilename(filename))
+			return os.Remove(filename)
+		}
+		if readRefs(filename) != refs {
+			return writeRefs(filename, refs)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func countBlobReferences() (map[string]int, error) {
+	refsByHash := make(map[string]int)
+	users, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if !user.IsDir() || user.Name() == BLOBS_DIR_NAME {
+			continue
+		}
+		err := filepath.Walk(getUserDataPath(user.Name()), func(filename string, fInfo os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil || !strings.HasPrefix(fInfo.Name(), META_FILE_NAME_PREFIX) {
+				return err
+			}
+			metaJson, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+			var meta map[string]string
+			if err := json.Unmarshal(metaJson, &meta); err != nil {
+				return errors.New(filename + ": " + err.Error())
+			}
+			if hash := meta[META_BLOB]; hash != "" {
+				refsByHash[hash]++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refsByHash, nil
+}
@@ -0,0 +1,178 @@
+package gors
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"libs/assrt"
+)
+
+func withDedup(t *testing.T) func() {
+	done := withTempStorage(t)
+	blobs = newBlobStore(dataPath + "/" + BLOBS_DIR_NAME)
+	storage = dedupStorage{fsStorage{}, blobs, false}
+	addAuthorization(Authorization{"user2", "example.com", []Scope{Scope{"module", true}}, "fs-token-2"})
+	return func() {
+		done()
+		blobs = nil
+		storage = fsStorage{}
+		removeAuthorization("fs-token-2")
+	}
+}
+
+func countBlobs() int {
+	count := 0
+	dirs, _ := ioutil.ReadDir(blobs.dir)
+	for _, dir := range dirs {
+		files, _ := ioutil.ReadDir(blobs.dir + "/" + dir.Name())
+		for _, f := range files {
+			if !strings.HasSuffix(f.Name(), ".refs") {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestDedupStorage(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withDedup(t)
+	defer done()
+
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user1/module/file.txt", "same text", "fs-token"))
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user1/module/copy.txt", "same text", "fs-token"))
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user2/module/file.txt", "same text", "fs-token-2"))
+	assert.Equal(1, countBlobs())
+	hash := dedupStorage{fsStorage{}, blobs, false}.blobHash("user1", "/module/file.txt")
+	assert.Equal(3, readRefs(blobs.blobFilename(hash)))
+
+	w := httptest.NewRecorder()
+	handleStorage(w, requestWithToken("GET", STORAGE_PATH + "user2/module/file.txt", "", "fs-token-2"))
+	assert.Equal("same text", w.Body.String())
+
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user1/module/file.txt", "other text", "fs-token"))
+	assert.Equal(2, countBlobs())
+	assert.Equal(2, readRefs(blobs.blobFilename(hash)))
+
+	handleStorage(httptest.NewRecorder(), requestWithToken("DELETE", STORAGE_PATH + "user1/module/copy.txt", "", "fs-token"))
+	handleStorage(httptest.NewRecorder(), requestWithToken("DELETE", STORAGE_PATH + "user2/module/file.txt", "", "fs-token-2"))
+	assert.Equal(1, countBlobs())
+	_, err := os.Stat(blobs.blobFilename(hash))
+	assert.True(os.IsNotExist(err))
+
+	w = httptest.NewRecorder()
+	handleStorage(w, requestWithToken("GET", STORAGE_PATH + "user1/module/file.txt", "", "fs-token"))
+	assert.Equal("other text", w.Body.String())
+}
+
+func TestDedupStorageWithConcurrentWritesToSamePath(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withDedup(t)
+	defer done()
+	dedup := dedupStorage{fsStorage{}, blobs, false}
+	dedup.Put("user1", "/module/copy.txt", strings.NewReader("same text"), &Item{ContentType: "text/plain"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i % 3 == 0 {
+				dedup.Delete("user1", "/module/file.txt")
+			} else {
+				dedup.Put("user1", "/module/file.txt", strings.NewReader("same text"), &Item{ContentType: "text/plain"})
+			}
+		}(i)
+	}
+	wg.Wait()
+	dedup.Put("user1", "/module/file.txt", strings.NewReader("same text"), &Item{ContentType: "text/plain"})
+
+	hash := dedup.blobHash("user1", "/module/file.txt")
+	assert.Equal(2, readRefs(blobs.blobFilename(hash)))
+	dedup.Delete("user1", "/module/file.txt")
+	assert.Equal(1, readRefs(blobs.blobFilename(hash)))
+	w := httptest.NewRecorder()
+	handleStorage(w, requestWithToken("GET", STORAGE_PATH + "user1/module/copy.txt", "", "fs-token"))
+	assert.Equal("same text", w.Body.String())
+	assert.Equal(0, len(blobs.pathLocks))
+}
+
+func TestDedupStorageWithoutDedup(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withDedup(t)
+	defer done()
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user1/module/file.txt", "same text", "fs-token"))
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user1/module/copy.txt", "same text", "fs-token"))
+	hash := dedupStorage{fsStorage{}, blobs, false}.blobHash("user1", "/module/file.txt")
+
+	// the server restarted without -dedup
+	storage = dedupStorage{fsStorage{}, blobs, true}
+	w := httptest.NewRecorder()
+	handleStorage(w, requestWithToken("GET", STORAGE_PATH + "user1/module/file.txt", "", "fs-token"))
+	assert.Equal("same text", w.Body.String())
+
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user1/module/file.txt", "new text", "fs-token"))
+	stored, _ := ioutil.ReadFile(getUserDataPath("user1") + "/module/file.txt")
+	assert.Equal("new text", string(stored))
+	assert.Equal(1, readRefs(blobs.blobFilename(hash)))
+	w = httptest.NewRecorder()
+	handleStorage(w, requestWithToken("GET", STORAGE_PATH + "user1/module/file.txt", "", "fs-token"))
+	assert.Equal("new text", w.Body.String())
+
+	handleStorage(httptest.NewRecorder(), requestWithToken("DELETE", STORAGE_PATH + "user1/module/copy.txt", "", "fs-token"))
+	assert.Equal(0, countBlobs())
+}
+
+func TestBlobGarbageCollection(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withDedup(t)
+	defer done()
+
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user1/module/file.txt", "text", "fs-token"))
+	hash := dedupStorage{fsStorage{}, blobs, false}.blobHash("user1", "/module/file.txt")
+	writeRefs(blobs.blobFilename(hash), 5)
+	orphan, _ := blobs.add(strings.NewReader("orphan"))
+
+	removed, err := blobs.collectGarbage()
+	assert.MustNil(err)
+	assert.Equal(1, removed)
+	assert.Equal(1, readRefs(blobs.blobFilename(hash)))
+	_, err = os.Stat(blobs.blobFilename(orphan))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestBlobGarbageCollectionWithConcurrentWrites(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withDedup(t)
+	defer done()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("%smodule/file%d.txt", STORAGE_PATH + "user1/", i)
+			for j := 0; j < 20; j++ {
+				handleStorage(httptest.NewRecorder(), requestWithToken("PUT", path, fmt.Sprint("text ", j % 3), "fs-token"))
+			}
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		_, err := blobs.collectGarbage()
+		assert.Nil(err)
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i++ {
+		w := httptest.NewRecorder()
+		handleStorage(w, requestWithToken("GET", fmt.Sprintf("%smodule/file%d.txt", STORAGE_PATH + "user1/", i), "", "fs-token"))
+		assert.Equal("text 1", w.Body.String())
+	}
+	removed, _ := blobs.collectGarbage()
+	assert.Equal(0, removed)
+	assert.Equal(1, countBlobs())
+}
@@ -0,0 +1,170 @@
+package gors
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/* ------------------------------------ Git History ----------------------------- */
+
+// In git mode the data folder of every user is the work tree of a git repository,
+// which lives outside of it in the .gors folder, so it never shows up in listings.
+// Every change through handleStorage becomes a commit of its user.
+
+var HISTORY_PATH = GORS_PATH + "/history/"
+
+var HISTORY_PATH_PATTERN = regexp.MustCompile("^" + HISTORY_PATH + "([^/]+)(/.*)$")
+
+var gitMutex sync.Mutex
+
+type Commit struct {
+	Commit  string `json:"commit"`
+	Author  string `json:"author"`
+	Date    string `json:"date"`
+	Message string `json:"message"`
+}
+
+func userGitDir(username string) string {
+	return userGorsDir(username) + "history.git"
+}
+
+func commitChange(change Change) {
+	gitMutex.Lock()
+	defer gitMutex.Unlock()
+
+	gitDir := userGitDir(change.Username)
+	if existGitDir, _ := exists(gitDir); !existGitDir {
+		if _, err := git(change.Username, "init", "-q"); err != nil {
+			fmt.Println("Error while creating git repository:", err)
+			return
+		}
+	}
+	// only the changed document is staged, because other clients might be writing at the same time
+	paths, err := gitChangedPaths(change.Username, change.Path)
+	if err != nil {
+		fmt.Println("Error while adding to git:", err)
+		return
+	}
+	if len(paths) > 0 {
+		if _, err := git(change.Username, append([]string{"add", "-A", "--"}, paths...)...); err != nil {
+			fmt.Println("Error while adding to git:", err)
+			return
+		}
+	}
+	author := change.Username + " <" + change.Username + "@gors>"
+	message := change.ClientId + ": " + change.Method + " " + change.Path
+	if _, err := git(change.Username, "commit", "-q", "--allow-empty", "--author", author, "-m", message); err != nil {
+		fmt.Println("Error while committing to git:", err)
+		return
+	}
+	chownTreeIfNeeded(gitDir, change.Username)
+}
+
+// gitChangedPaths returns the files of the document and its meta data, which exist or are tracked
+// (git doesn't accept pathspecs, which match nothing).
+func gitChangedPaths(username string, path string) ([]string, error) {
+	candidates := []string{"." + path, contentTypeFilename("." + path), metaFilename("." + path)}
+	tracked, err := git(username, append([]string{"ls-files", "-z", "--"}, candidates...)...)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, candidate := range candidates {
+		existFile, _ := exists(getUserDataPath(username) + candidate[1:])
+		if existFile || strings.Contains("\x00" + tracked, "\x00" + candidate[2:] + "\x00") {
+			paths = append(paths, candidate)
+		}
+	}
+	return paths, nil
+}
+
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+
+	if (r.Method == "OPTIONS") {
+		return;
+	}
+
+	pathParts := HISTORY_PATH_PATTERN.FindStringSubmatch(r.URL.Path)
+	if len(pathParts) < 3 || r.Method != "GET" {
+		w.WriteHeader(400)
+		return;
+	}
+
+	username := pathParts[1]
+	pathInUserStorage := pathParts[2]
+
+	if authorization, authError := getAuthorization(r, username, pathInUserStorage); authorization == nil {
+		writeBearerChallenge(w, authError, requiredScope(pathInUserStorage, false))
+		return;
+	}
+
+	commits, err := gitLog(username, pathInUserStorage)
+	if err != nil {
+		fmt.Println("Error while reading git log:", err)
+		w.WriteHeader(500)
+		return;
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commits)
+}
+
+func gitLog(username string, path string) ([]Commit, error) {
+	commits := []Commit{}
+	if existGitDir, _ := exists(userGitDir(username)); !existGitDir {
+		return commits, nil
+	}
+
+	pathspec := "." + path
+	output, err := git(username, "log", "--format=%H%x00%an%x00%aI%x00%s", "--", pathspec)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) == 4 {
+			commits = append(commits, Commit{fields[0], fields[1], fields[2], fields[3]})
+		}
+	}
+	return commits, nil
+}
+
+func git(username string, args ...string) (string, error) {
+	// git runs inside the work tree, so relative storage paths would point elsewhere
+	workTree, _ := filepath.Abs(getUserDataPath(username))
+	gitDir, _ := filepath.Abs(userGitDir(username))
+	os.MkdirAll(workTree, os.ModePerm)
+	args = append([]string{"--git-dir=" + gitDir, "--work-tree=" + workTree}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = workTree
+	// storage paths may contain *, ? or [, which must not be globs
+	cmd.Env = append(os.Environ(), "GIT_COMMITTER_NAME=gors", "GIT_COMMITTER_EMAIL=gors@localhost", "GIT_LITERAL_PATHSPECS=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.New(err.Error() + ": " + stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+func chownTreeIfNeeded(root string, username string) {
+	if chown == "" {
+		return
+	}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			chownIfNeeded(path, username)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,93 @@
+package gors
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"libs/assrt"
+)
+
+func withTempStorage(t *testing.T) func() {
+	tempDir, err := ioutil.TempDir("", "gors-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDataPath := dataPath
+	dataPath = tempDir
+	addAuthorization(Authorization{"user1", "example.com", []Scope{Scope{"module", true}}, "fs-token"})
+	return func() {
+		os.RemoveAll(tempDir)
+		dataPath = oldDataPath
+		removeAuthorization("fs-token")
+	}
+}
+
+func requestWithToken(method string, url string, body string, token string) *http.Request {
+	r, _ := http.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer " + token)
+	return r
+}
+
+func TestGitHistory(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withTempStorage(t)
+	defer done()
+	changeListeners = []func(Change){commitChange}
+	defer func() { changeListeners = nil }()
+
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user1/module/file.txt", "text", "fs-token"))
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user1/module/other.txt", "other", "fs-token"))
+	handleStorage(httptest.NewRecorder(), requestWithToken("DELETE", STORAGE_PATH + "user1/module/file.txt", "", "fs-token"))
+
+	w := httptest.NewRecorder()
+	handleHistory(w, requestWithToken("GET", HISTORY_PATH + "user1/module/file.txt", "", "fs-token"))
+	assert.Equal(200, w.Code)
+	var commits []Commit
+	assert.MustNil(json.Unmarshal(w.Body.Bytes(), &commits))
+	assert.MustEqual(2, len(commits))
+	assert.Equal("example.com: DELETE /module/file.txt", commits[0].Message)
+	assert.Equal("example.com: PUT /module/file.txt", commits[1].Message)
+	assert.Equal("user1", commits[1].Author)
+
+	w = httptest.NewRecorder()
+	handleHistory(w, requestWithToken("GET", HISTORY_PATH + "user1/module/", "", "fs-token"))
+	json.Unmarshal(w.Body.Bytes(), &commits)
+	assert.Equal(3, len(commits))
+
+	w = httptest.NewRecorder()
+	handleStorage(w, requestWithToken("GET", STORAGE_PATH + "user1/module/", "", "fs-token"))
+	var listing map[string]string
+	json.Unmarshal(w.Body.Bytes(), &listing)
+	assert.Equal(1, len(listing))
+	assert.NotEqual("", listing["other.txt"])
+
+	w = httptest.NewRecorder()
+	handleHistory(w, requestWithToken("GET", HISTORY_PATH + "user1/other-module/", "", "fs-token"))
+	assert.Equal(403, w.Code)
+}
+
+func TestGitCommitsOnlyTheChangedDocument(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withTempStorage(t)
+	defer done()
+	changeListeners = []func(Change){commitChange}
+	defer func() { changeListeners = nil }()
+
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user1/module/file.txt", "text", "fs-token"))
+	// written by another client, whose commit hasn't happened yet
+	ioutil.WriteFile(getUserDataPath("user1") + "/module/concurrent.txt", []byte("other"), 0644)
+	handleStorage(httptest.NewRecorder(), requestWithToken("PUT", STORAGE_PATH + "user1/module/f*.txt", "glob", "fs-token"))
+
+	files, err := git("user1", "show", "--name-only", "--format=", "HEAD")
+	assert.MustNil(err)
+	assert.Equal("module/.rsct.f*.txt\nmodule/f*.txt\n", files)
+
+	handleStorage(httptest.NewRecorder(), requestWithToken("DELETE", STORAGE_PATH + "user1/module/file.txt", "", "fs-token"))
+	files, _ = git("user1", "show", "--name-only", "--format=", "HEAD")
+	assert.True(strings.Contains(files, "module/file.txt\n"), files)
+	assert.True(!strings.Contains(files, "concurrent.txt"), files)
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"encoding/json"
+	"errors"
 	"regexp"
 	"html/template"
 	"strings"
@@ -12,9 +14,12 @@ import (
 	"libs/uniuri"
 	"io"
 	"io/ioutil"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/hex"
 	"os"
 	"os/user"
+	"sync"
 	"time"
 )
 
@@ -25,18 +30,6 @@ const (
 	HOME     = "home"
 )
 
-type Scope struct {
-	path  string;
-	write bool
-}
-
-func (s Scope) String() string {
-	if (s.write) {
-		return s.path + " (Full Access)"
-	}
-	return s.path
-}
-
 type Authorization struct {
 	username      string
 	clientId      string
@@ -44,6 +37,135 @@ type Authorization struct {
 	bearerToken   string
 }
 
+// Item describes a document or folder in the storage of a user.
+type Item struct {
+	Name        string
+	IsDir       bool
+	ModTime     time.Time
+	Size        int64
+	ContentType string
+	// ContentEncoding is set if the document is served in stored (encoded) form.
+	ContentEncoding string
+	// Meta holds additional properties, which are stored together with the document.
+	Meta map[string]string
+}
+
+// Document is the body of a stored document as returned by Storage.Open.
+type Document interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Change describes a successful modification of a document by a client.
+type Change struct {
+	Method   string
+	Username string
+	ClientId string
+	Path     string
+}
+
+// Storage is the place where the documents of all users are kept.
+// Paths are relative to the storage root of a user and start with "/".
+// Methods return an error satisfying os.IsNotExist for missing documents.
+type Storage interface {
+	Stat(username string, path string) (*Item, error)
+	List(username string, path string) ([]Item, error)
+	Open(username string, path string) (Document, *Item, error)
+	Put(username string, path string, body io.Reader, meta *Item) (*Item, error)
+	Delete(username string, path string) error
+}
+
+const (
+	FILESYSTEM_BACKEND = "fs"
+	S3_BACKEND         = "s3"
+)
+
+type Config struct {
+	StorageDir          string
+	StorageMode         StorageMode
+	Chown               string
+	ResourcesPath       string
+	Port                int
+	ExternalBaseUrl     string
+	Backend             string
+	S3                  S3Config
+	Git                 bool
+	SecretFile          string
+	Encrypt             bool
+	Compression         string
+	Dedup               bool
+	Domains             Domains
+	// SpecVersion (like "draft-dejong-remotestorage-02") is advertised in an additional webfinger link
+	SpecVersion         string
+	WebfingerProperties Properties
+	AuthCodeFlow        bool
+	// QueryTokens lets apps send the token as access_token query parameter for GET requests (e.g. of media elements)
+	QueryTokens         bool
+	// Authenticator checks passwords: FILE_AUTHENTICATOR (default), LDAP_AUTHENTICATOR,
+	// HTPASSWD_AUTHENTICATOR or OWNCLOUD_AUTHENTICATOR
+	Authenticator       string
+	LDAP                LDAPConfig
+	HtpasswdFile        string
+	OwnCloud            OwnCloudConfig
+	Registration        RegistrationConfig
+	MinPasswordLength   int
+	// SignedTokens enables stateless tokens signed with the keys of TokenKeysFile (or the server secret)
+	SignedTokens        bool
+	TokenKeysFile       string
+	TokenLifetime       time.Duration
+	// TokenLength is the number of characters of random tokens (at least MIN_TOKEN_LENGTH)
+	TokenLength         int
+}
+
+// Domains maps every served domain to its external base URL ("" for the default base URL).
+// It's a flag.Value, which accepts "example.com" or "example.com=https://example.com/storage".
+type Domains map[string]string
+
+func (d Domains) String() string {
+	domains := []string{}
+	for domain, baseUrl := range d {
+		if baseUrl == "" {
+			domains = append(domains, domain)
+		} else {
+			domains = append(domains, domain + "=" + baseUrl)
+		}
+	}
+	return strings.Join(domains, ",")
+}
+
+func (d Domains) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	domain := strings.ToLower(strings.TrimSpace(parts[0]))
+	if domain == "" {
+		return errors.New("Empty domain")
+	}
+	d[domain] = ""
+	if len(parts) == 2 {
+		d[domain] = strings.TrimSuffix(strings.TrimSpace(parts[1]), "/")
+	}
+	return nil
+}
+
+// Properties is a flag.Value, which accepts "key=value" pairs.
+type Properties map[string]string
+
+func (p Properties) String() string {
+	properties := []string{}
+	for key, value := range p {
+		properties = append(properties, key + "=" + value)
+	}
+	return strings.Join(properties, ",")
+}
+
+func (p Properties) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.New("Expected key=value")
+	}
+	p[parts[0]] = parts[1]
+	return nil
+}
+
 const GORS_PATH = "/gors"
 
 var STORAGE_PATH = GORS_PATH + "/storage/"
@@ -53,23 +175,143 @@ var storageMode StorageMode
 var chown string
 var resourcesPath string
 var externalBaseUrl string
-
-func StartServer(storageDir string, storageModePara StorageMode, chownPara string, resourcesPathPara string, port int, externalBaseUrlPara string) {
-	dataPath = storageDir
-	storageMode = storageModePara
-	chown = chownPara
-	resourcesPath = resourcesPathPara
-	externalBaseUrl = externalBaseUrlPara
-	http.HandleFunc("/.well-known/host-meta.json", handleWebfinger)
+var domains Domains
+var specVersion string
+var queryTokens bool
+var webfingerProperties Properties
+var authCodeFlow bool
+var serverSecret []byte
+var storage Storage = fsStorage{}
+var blobs *blobStore
+var changeListeners []func(Change)
+
+func StartServer(config Config) {
+	configure(config)
+	if blobs != nil {
+		go blobs.collectGarbagePeriodically()
+	}
+	http.HandleFunc(WEBFINGER_PATH, handleWebfinger)
+	http.HandleFunc(LEGACY_WEBFINGER_PATH, handleWebfinger)
 	http.HandleFunc(AUTH_PATH, handleAuth)
+	http.HandleFunc(DASHBOARD_PATH, handleDashboard)
+	if registration.Mode != "" {
+		http.HandleFunc(REGISTER_PATH, handleRegister)
+	}
+	http.HandleFunc(PASSWORD_RESET_PATH, handlePasswordReset)
+	http.HandleFunc(REVOKE_PATH, handleRevoke)
+	http.HandleFunc(SHARE_PATH, handleShare)
+	if authCodeFlow {
+		http.HandleFunc(TOKEN_PATH, handleToken)
+	}
 	http.HandleFunc(STORAGE_PATH, handleStorage)
+	if config.Git {
+		http.HandleFunc(HISTORY_PATH, handleHistory)
+	}
 	http.Handle(GORS_PATH + "/css/", http.StripPrefix(GORS_PATH + "/css/", http.FileServer(http.Dir(resourcesPath + "/css"))))
-	err := http.ListenAndServe(":" + strconv.Itoa(port), nil)
+	err := http.ListenAndServe(":" + strconv.Itoa(config.Port), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+func configure(config Config) {
+	dataPath = config.StorageDir
+	storageMode = config.StorageMode
+	chown = config.Chown
+	resourcesPath = config.ResourcesPath
+	externalBaseUrl = config.ExternalBaseUrl
+	domains = config.Domains
+	specVersion = config.SpecVersion
+	queryTokens = config.QueryTokens
+	webfingerProperties = config.WebfingerProperties
+	authCodeFlow = config.AuthCodeFlow
+	switch config.Authenticator {
+	case LDAP_AUTHENTICATOR:
+		authenticator = ldapAuthenticator{config.LDAP}
+	case HTPASSWD_AUTHENTICATOR:
+		htpasswd, err := newHtpasswdAuthenticator(config.HtpasswdFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		authenticator = htpasswd
+	case OWNCLOUD_AUTHENTICATOR:
+		ownCloud, err := newOwnCloudAuthenticator(config.OwnCloud)
+		if err != nil {
+			log.Fatal(err)
+		}
+		authenticator = ownCloud
+	case FILE_AUTHENTICATOR, "":
+		authenticator = passwordFileAuthenticator{}
+	default:
+		log.Fatal("Unknown authenticator: " + config.Authenticator)
+	}
+	minPasswordLength = config.MinPasswordLength
+	if minPasswordLength <= 0 {
+		minPasswordLength = DEFAULT_MIN_PASSWORD_LENGTH
+	}
+	if err := configureRegistration(config.Registration); err != nil {
+		log.Fatal(err)
+	}
+	switch config.Backend {
+	case S3_BACKEND:
+		storage = newS3Storage(config.S3)
+	case FILESYSTEM_BACKEND, "":
+		storage = fsStorage{}
+	default:
+		log.Fatal("Unknown storage backend: " + config.Backend)
+	}
+	if config.Git {
+		if _, isFsStorage := storage.(fsStorage); !isFsStorage {
+			log.Fatal("Git history needs the fs storage backend")
+		}
+		changeListeners = append(changeListeners, commitChange)
+	}
+	if config.SecretFile != "" {
+		secret, err := ioutil.ReadFile(config.SecretFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverSecret = []byte(strings.TrimSpace(string(secret)))
+	}
+	tokenLength = config.TokenLength
+	if tokenLength == 0 {
+		tokenLength = DEFAULT_TOKEN_LENGTH
+	} else if tokenLength < MIN_TOKEN_LENGTH {
+		log.Fatal("Tokens need at least " + strconv.Itoa(MIN_TOKEN_LENGTH) + " characters")
+	}
+	if err := configureSignedTokens(config); err != nil {
+		log.Fatal(err)
+	}
+	if config.Encrypt {
+		if len(serverSecret) == 0 {
+			log.Fatal("Encryption needs a server secret")
+		}
+		storage = encryptingStorage{storage}
+	}
+	if config.Dedup {
+		if _, isFsStorage := storage.(fsStorage); !isFsStorage {
+			log.Fatal("Deduplication needs the fs storage backend without encryption")
+		}
+		if config.Git {
+			log.Fatal("Git history can't be used together with deduplication")
+		}
+		blobs = newBlobStore(dataPath + "/" + BLOBS_DIR_NAME)
+		storage = dedupStorage{storage, blobs, false}
+	} else if existBlobs, _ := exists(dataPath + "/" + BLOBS_DIR_NAME); existBlobs {
+		// documents stored with -dedup before still point to their blobs
+		blobs = newBlobStore(dataPath + "/" + BLOBS_DIR_NAME)
+		storage = dedupStorage{storage, blobs, true}
+	}
+	// documents are compressed before they are encrypted, because ciphertext doesn't compress.
+	// Without -compress the wrapper only decodes documents, which were stored compressed before.
+	switch config.Compression {
+	case GZIP_COMPRESSION, "":
+		storage = compressingStorage{storage, config.Compression}
+	default:
+		log.Fatal("Unknown compression: " + config.Compression)
+	}
+}
+
 /* ------------------------------------ Storage ----------------------------- */
 
 var STORAGE_PATH_PATTERN = regexp.MustCompile("^" + STORAGE_PATH + "([^/]+)(/.*)$")
@@ -90,24 +332,27 @@ func handleStorage(w http.ResponseWriter, r *http.Request) {
 	username := pathParts[1]
 	pathInUserStorage := pathParts[2]
 
-	if !isAuthorized(r, pathInUserStorage) {
-		w.WriteHeader(401)
+	if !takeQueryToken(w, r) {
+		writeBearerChallenge(w, INVALID_REQUEST_ERROR, requiredScope(pathInUserStorage, r.Method != "GET"))
+		return;
+	}
+	authorization, authError := getAuthorization(r, username, pathInUserStorage)
+	if authorization == nil && !isPublicRead(r, pathInUserStorage) {
+		writeBearerChallenge(w, authError, requiredScope(pathInUserStorage, r.Method != "GET"))
 		return;
 	}
 
-	userStoragePath := getUserDataPath(username)
 	switch r.Method {
 	case "GET":
-		filename := userStoragePath + pathInUserStorage
-		if isDirListingRequest(filename) {
-			handleDirectoryListing(w, r, filename)
+		if isDirListingRequest(pathInUserStorage) {
+			handleDirectoryListing(w, r, username, pathInUserStorage)
 		} else {
-			handleGetFile(w, r, filename)
+			handleGetFile(w, r, username, pathInUserStorage)
 		}
 	case "PUT":
-		handlePutFile(w, r, userStoragePath, pathInUserStorage, username)
+		handlePutFile(w, r, authorization, pathInUserStorage)
 	case "DELETE":
-		handleDeleteFile(w, r, userStoragePath, pathInUserStorage)
+		handleDeleteFile(w, r, authorization, pathInUserStorage)
 	default:
 		w.WriteHeader(500)
 	}
@@ -117,73 +362,141 @@ func isDirListingRequest(path string) bool {
 	return strings.HasSuffix(path, "/")
 }
 
-func isAuthorized(r *http.Request, pathInUserStorage string) bool {
-	if r.Method == "GET" && strings.HasPrefix(pathInUserStorage, "/public") && !isDirListingRequest(pathInUserStorage) {
-		// everybody can read public data, so we need no authorization
-		return true
-	} else if getAuthorization(r, pathInUserStorage) != nil {
+// Everybody can read public documents (but not list public folders) without authorization.
+func isPublicRead(r *http.Request, pathInUserStorage string) bool {
+	return r.Method == "GET" && strings.HasPrefix(pathInUserStorage, "/public") && !isDirListingRequest(pathInUserStorage)
+}
+
+const QUERY_TOKEN_PARAMETER = "access_token"
+
+// takeQueryToken moves the token of the access_token query parameter (http://tools.ietf.org/html/rfc6750#section-2.3)
+// to the Authorization header, so it doesn't show up in logs or anything else, which uses the URL.
+// Requests, which send the token in both ways, are invalid.
+func takeQueryToken(w http.ResponseWriter, r *http.Request) bool {
+	query := r.URL.Query()
+	if !queryTokens || r.Method != "GET" || len(query[QUERY_TOKEN_PARAMETER]) == 0 {
 		return true
 	}
-	return false
+	bearerToken, isSingle := singleParameter(query, QUERY_TOKEN_PARAMETER)
+	query.Del(QUERY_TOKEN_PARAMETER)
+	r.URL.RawQuery = query.Encode()
+	r.RequestURI = r.URL.RequestURI()
+	if !isSingle || len(r.Header["Authorization"]) > 0 {
+		return false
+	}
+	r.Header.Set("Authorization", "Bearer " + bearerToken)
+	// the response must not be cached by shared caches, because everybody could request the URL
+	w.Header().Set("Cache-Control", "private")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	return true
 }
 
-func getAuthorization(r *http.Request, pathInUserStorage string) *Authorization {
+// Errors of requests with bearer tokens (http://tools.ietf.org/html/rfc6750#section-3.1)
+const (
+	INVALID_REQUEST_ERROR    = "invalid_request"
+	INVALID_TOKEN_ERROR      = "invalid_token"
+	INSUFFICIENT_SCOPE_ERROR = "insufficient_scope"
+)
+
+// b64token of http://tools.ietf.org/html/rfc6750#section-2.1
+var BEARER_TOKEN_PATTERN = regexp.MustCompile(`^[A-Za-z0-9\-._~+/]+=*$`)
+
+// getAuthorization returns the authorization of the request for the path or why there is none
+// (one of the errors above, or "" if the request has no bearer token at all).
+func getAuthorization(r *http.Request, username string, pathInUserStorage string) (*Authorization, string) {
 	// no Bearer Token ?
 	if len(r.Header["Authorization"]) == 0 {
-		return nil;
+		return nil, "";
+	}
+	if len(r.Header["Authorization"]) > 1 {
+		return nil, INVALID_REQUEST_ERROR
 	}
 
-	bearerToken := strings.TrimPrefix(r.Header["Authorization"][0], "Bearer ")
+	bearerToken, authError := parseBearerToken(r.Header["Authorization"][0])
+	if bearerToken == "" {
+		return nil, authError
+	}
 
 	// invalid Bearer Token ?
-	authorization := authorizationByBearer[bearerToken]
+	authorization := lookupAuthorization(bearerToken)
 	if authorization == nil {
-		return nil;
+		return nil, INVALID_TOKEN_ERROR;
 	}
 
 	// is Bearer Token valid for user?
-	if !strings.HasPrefix(r.URL.Path, STORAGE_PATH + authorization.username) {
-		fmt.Println("Token  " + bearerToken + " is invalid for path " + r.URL.Path + "and username " + authorization.username)
-		return nil;
+	if username != authorization.username {
+		fmt.Println("Token of " + authorization.clientId + " for user " + authorization.username + " is invalid for path " + r.URL.Path)
+		return nil, INVALID_TOKEN_ERROR;
 	}
 
 	// Is Bearer Token valid for Scopes
 	for _, scope := range authorization.scopes {
-		if (strings.HasPrefix(pathInUserStorage, "/" + scope.path + "/") ||
-				strings.HasPrefix(pathInUserStorage, "/public/" + scope.path + "/") ||
-				strings.HasPrefix(scope.path, "root")) &&
-				(r.Method == "GET" || (scope.write)) {
-			return authorization
+		if scope.covers(pathInUserStorage) && (r.Method == "GET" || (scope.write)) {
+			return authorization, ""
 		}
 	}
 
-	return nil
+	return nil, INSUFFICIENT_SCOPE_ERROR
+}
+
+// parseBearerToken returns the token of an Authorization header with the Bearer scheme.
+// Other schemes (like Basic) count as no token, malformed Bearer credentials are an invalid request.
+func parseBearerToken(header string) (string, string) {
+	parts := strings.SplitN(header, " ", 2)
+	if !strings.EqualFold(parts[0], "Bearer") {
+		return "", ""
+	}
+	if len(parts) < 2 {
+		return "", INVALID_REQUEST_ERROR
+	}
+	bearerToken := strings.TrimLeft(parts[1], " ")
+	if !BEARER_TOKEN_PATTERN.MatchString(bearerToken) {
+		return "", INVALID_REQUEST_ERROR
+	}
+	return bearerToken, ""
+}
+
+// writeBearerChallenge answers a request without sufficient authorization (http://tools.ietf.org/html/rfc6750#section-3)
+// with the error and the scope, which is needed.
+func writeBearerChallenge(w http.ResponseWriter, authError string, scope Scope) {
+	challenge := "Bearer"
+	if authError != "" {
+		challenge += ` error="` + authError + `",`
+	}
+	w.Header().Set("WWW-Authenticate", challenge + ` scope="` + formatScopes([]Scope{scope}) + `"`)
+	switch authError {
+	case INVALID_REQUEST_ERROR:
+		w.WriteHeader(400)
+	case INSUFFICIENT_SCOPE_ERROR:
+		w.WriteHeader(403)
+	default:
+		w.WriteHeader(401)
+	}
 }
 
-func handleDirectoryListing(w http.ResponseWriter, r *http.Request, dirName string) {
-	if needs304Response(r, dirName) {
+func handleDirectoryListing(w http.ResponseWriter, r *http.Request, username string, path string) {
+	if needs304Response(r, username, path) {
 		w.WriteHeader(304)
 		return;
 	}
 
-	files, err := ioutil.ReadDir(dirName)
+	items, err := storage.List(username, path)
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Handle non existing and empty dirs
-	if err != nil || len(files) == 0 {
+	if err != nil || len(items) == 0 {
 		w.WriteHeader(404)
 	} else {
-		fInfo, _ := os.Stat(dirName)
-		addETagFromFileInfo(w, fInfo)
+		item, _ := storage.Stat(username, path)
+		addETagFromItem(w, item)
 		w.WriteHeader(200)
 	}
 
 	fmt.Fprint(w, "{\n")
-	realFiles := ignoreMetaFiles(files)
-	for i, f := range realFiles {
-		fmt.Fprintf(w, `"%s":"%d"`, itemName(f), f.ModTime().Unix())
-		if i < len(realFiles) - 1 {
+	for i, item := range items {
+		fmt.Fprintf(w, `"%s":"%d"`, itemName(item), item.ModTime.Unix())
+		if i < len(items) - 1 {
 			fmt.Fprintf(w, ",")
 		}
 		fmt.Fprintf(w, "\n")
@@ -191,106 +504,71 @@ func handleDirectoryListing(w http.ResponseWriter, r *http.Request, dirName stri
 	fmt.Fprint(w, "}\n")
 }
 
-func ignoreMetaFiles(files []os.FileInfo) []os.FileInfo {
-	var realFiles = make([]os.FileInfo,0, len(files)/2)
-	for _, f := range files {
-		if !strings.HasPrefix(f.Name(), CONTENT_TYPE_FILE_NAME_PREFIX) {
-			realFiles = append(realFiles, f)
-		}
-	}
-	return realFiles
-}
-
-func handleGetFile(w http.ResponseWriter, r *http.Request, filename string) {
-	if needs304Response(r, filename) {
+func handleGetFile(w http.ResponseWriter, r *http.Request, username string, path string) {
+	if needs304Response(r, username, path) {
 		w.WriteHeader(304)
 		return;
 	}
 
-	f, err := os.Open(filename)
+	doc, item, err := storage.Open(username, path)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
-	defer f.Close()
-	contentType, _ := ioutil.ReadFile(contentTypeFilename(filename))
-	w.Header().Set("Content-Type", string(contentType))
-	fInfo, _ := f.Stat()
-	addETagFromFileInfo(w, fInfo)
-	http.ServeContent(w, r, fInfo.Name(), fInfo.ModTime(), f)
+	defer doc.Close()
+	w.Header().Set("Content-Type", item.ContentType)
+	addETagFromItem(w, item)
+	var content io.ReadSeeker = doc
+	if item.ContentEncoding != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsEncoding(r, item.ContentEncoding) {
+			w.Header().Set("Content-Encoding", item.ContentEncoding)
+		} else if content, err = decodeDocument(doc, item.ContentEncoding); err != nil {
+			fmt.Println("Error", err)
+			w.WriteHeader(500)
+			return
+		}
+	}
+	http.ServeContent(w, r, item.Name, item.ModTime, content)
 }
 
-func handlePutFile(w http.ResponseWriter, r *http.Request, userStoragePath string, pathInUserStorage string, username string) {
-	filename := userStoragePath + pathInUserStorage;
-
-	if needs412Response(r, filename) {
+func handlePutFile(w http.ResponseWriter, r *http.Request, authorization *Authorization, path string) {
+	username := authorization.username
+	if needs412Response(r, username, path) {
 		w.WriteHeader(412)
 		return;
 	}
 
-	ensurePath(filename, username)
-	f, err := os.Create(filename)
+	item, err := storage.Put(username, path, r.Body, &Item{ContentType: r.Header.Get("Content-Type")})
 	if err != nil {
 		fmt.Println("Error", err)
 		w.WriteHeader(500)
 		return
 	}
-	defer f.Close()
-	io.Copy(f, r.Body)
-	err = ioutil.WriteFile(contentTypeFilename(filename), []byte(r.Header.Get("Content-Type")), 0644)
-	chownIfNeeded(contentTypeFilename(filename), username);
-	markAncestorFoldersAsModified(userStoragePath, pathInUserStorage)
-	chownAncestorFoldersIfNeeded(userStoragePath, pathInUserStorage, username)
-	addETag(w, filename)
-	chownIfNeeded(filename, username);
+	addETagFromItem(w, item)
 	w.WriteHeader(200)
+	notifyChangeListeners(r, authorization, path)
 }
 
-func chownIfNeeded(filename string, username string) {
-	if chown == "" {
-		return;
-	} else if (chown != "@") {
-		username = chown
-	}
-	user, err := user.Lookup(username)
-	if err != nil {
-		fmt.Println("Error while chown. Can't find user:", err)
-	}
-	uid, _ := strconv.Atoi(user.Uid)
-	gid, _ := strconv.Atoi(user.Gid)
-	err = os.Chown(filename, uid, gid)
-	if err != nil {
-		fmt.Println("Error while chown:", err, user)
-	}
-}
-
-
-
-func chownAncestorFoldersIfNeeded(basePath, modifiedPath string, username string) {
-	forAllAncestorFolders(basePath, modifiedPath, func(path string) {
-			chownIfNeeded(path, username)
-		})
-}
-
-func needs304Response(r *http.Request, filename string) bool {
+func needs304Response(r *http.Request, username string, path string) bool {
 	if ifNoneMatch := r.Header.Get("If-None-Match"); len(ifNoneMatch) > 0 {
-		fInfo, err := os.Stat(filename)
-		if (err == nil && getETag(fInfo) == ifNoneMatch) {
+		item, err := storage.Stat(username, path)
+		if (err == nil && getETag(item) == ifNoneMatch) {
 			return true
 		}
 	}
 	return false
 }
 
-func needs412Response(r *http.Request, filename string) bool {
+func needs412Response(r *http.Request, username string, path string) bool {
 	if ifMatch := r.Header.Get("If-Match"); len(ifMatch) > 0 {
-		fInfo, err := os.Stat(filename)
-		if (err != nil || getETag(fInfo) != ifMatch) {
+		item, err := storage.Stat(username, path)
+		if (err != nil || getETag(item) != ifMatch) {
 			return true
 		}
 	}
 	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch == "*" {
-		_, err := os.Stat(filename)
+		_, err := storage.Stat(username, path)
 		if (err == nil) {
 			return true
 		}
@@ -298,38 +576,184 @@ func needs412Response(r *http.Request, filename string) bool {
 	return false
 }
 
-func handleDeleteFile(w http.ResponseWriter, r *http.Request, userStoragePath string, pathInUserStorage string) {
-	filename := userStoragePath + pathInUserStorage;
-	if needs412Response(r, filename) {
+func handleDeleteFile(w http.ResponseWriter, r *http.Request, authorization *Authorization, path string) {
+	username := authorization.username
+	if needs412Response(r, username, path) {
 		w.WriteHeader(412)
 		return;
 	}
-	existFile, err := exists(filename)
-	if (!existFile) {
+	item, err := storage.Stat(username, path)
+	if (os.IsNotExist(err)) {
 		w.WriteHeader(404)
 		return;
 	} else if (err != nil) {
 		w.WriteHeader(500)
 		return;
 	}
-	addETag(w, filename)
-	os.Remove(filename)
+	addETagFromItem(w, item)
+	if err := storage.Delete(username, path); err != nil {
+		fmt.Println("Error", err)
+		w.WriteHeader(500)
+		return
+	}
+	notifyChangeListeners(r, authorization, path)
+}
+
+func notifyChangeListeners(r *http.Request, authorization *Authorization, path string) {
+	change := Change{r.Method, authorization.username, authorization.clientId, path}
+	for _, listener := range changeListeners {
+		listener(change)
+	}
+}
+
+func addETagFromItem(w http.ResponseWriter, item *Item) {
+	w.Header().Set("ETag", getETag(item))
+}
+
+func getETag(item *Item) string {
+	return fmt.Sprintf("\"%d\"", item.ModTime.Unix())
+}
+
+func itemName(item Item) string {
+	if item.IsDir {
+		return item.Name + "/"
+	}
+	return item.Name
+}
+
+/* ------------------------------------ Filesystem Storage ----------------------------- */
+
+// fsStorage keeps the documents of every user below getUserDataPath(username)
+// and the content type of a document in a hidden file next to it.
+type fsStorage struct{}
+
+func (fsStorage) Stat(username string, path string) (*Item, error) {
+	fInfo, err := os.Stat(getUserDataPath(username) + path)
+	if err != nil {
+		return nil, err
+	}
+	item := itemFromFileInfo(fInfo)
+	return &item, nil
+}
+
+func (fsStorage) List(username string, path string) ([]Item, error) {
+	files, err := ioutil.ReadDir(getUserDataPath(username) + path)
+	if err != nil {
+		return nil, err
+	}
+	realFiles := ignoreMetaFiles(files)
+	items := make([]Item, len(realFiles))
+	for i, f := range realFiles {
+		items[i] = itemFromFileInfo(f)
+	}
+	return items, nil
+}
+
+func (fsStorage) Open(username string, path string) (Document, *Item, error) {
+	filename := getUserDataPath(username) + path
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	fInfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	item := itemFromFileInfo(fInfo)
+	contentType, _ := ioutil.ReadFile(contentTypeFilename(filename))
+	item.ContentType = string(contentType)
+	if metaJson, err := ioutil.ReadFile(metaFilename(filename)); err == nil {
+		json.Unmarshal(metaJson, &item.Meta)
+	}
+	return f, &item, nil
+}
+
+func (fsStorage) Put(username string, path string, body io.Reader, meta *Item) (*Item, error) {
+	userStoragePath := getUserDataPath(username)
+	filename := userStoragePath + path
+	ensurePath(filename, username)
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, body)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(contentTypeFilename(filename), []byte(meta.ContentType), 0644)
+	if err != nil {
+		return nil, err
+	}
+	chownIfNeeded(contentTypeFilename(filename), username);
+	if len(meta.Meta) > 0 {
+		metaJson, _ := json.Marshal(meta.Meta)
+		err = ioutil.WriteFile(metaFilename(filename), metaJson, 0644)
+		if err != nil {
+			return nil, err
+		}
+		chownIfNeeded(metaFilename(filename), username);
+	} else {
+		os.Remove(metaFilename(filename))
+	}
+	markAncestorFoldersAsModified(userStoragePath, path)
+	chownAncestorFoldersIfNeeded(userStoragePath, path, username)
+	chownIfNeeded(filename, username);
+	return fsStorage{}.Stat(username, path)
+}
+
+func (fsStorage) Delete(username string, path string) error {
+	userStoragePath := getUserDataPath(username)
+	filename := userStoragePath + path
+	err := os.Remove(filename)
+	if err != nil {
+		return err
+	}
 	os.Remove(contentTypeFilename(filename))
-	markAncestorFoldersAsModified(userStoragePath, pathInUserStorage)
-	removeEmptyAncestorFolders(userStoragePath, pathInUserStorage)
+	os.Remove(metaFilename(filename))
+	markAncestorFoldersAsModified(userStoragePath, path)
+	removeEmptyAncestorFolders(userStoragePath, path)
+	return nil
 }
 
-func addETag(w http.ResponseWriter, filename string) {
-	fInfo, _ := os.Stat(filename)
-	addETagFromFileInfo(w, fInfo)
+func itemFromFileInfo(fInfo os.FileInfo) Item {
+	return Item{Name: fInfo.Name(), IsDir: fInfo.IsDir(), ModTime: fInfo.ModTime(), Size: fInfo.Size()}
 }
 
-func addETagFromFileInfo(w http.ResponseWriter, fInfo os.FileInfo) {
-	w.Header().Set("ETag", getETag(fInfo))
+func ignoreMetaFiles(files []os.FileInfo) []os.FileInfo {
+	var realFiles = make([]os.FileInfo,0, len(files)/2)
+	for _, f := range files {
+		if !isMetaFile(f.Name()) {
+			realFiles = append(realFiles, f)
+		}
+	}
+	return realFiles
 }
 
-func getETag(fInfo os.FileInfo) string {
-	return fmt.Sprintf("\"%d\"", fInfo.ModTime().Unix())
+func chownIfNeeded(filename string, username string) {
+	if chown == "" {
+		return;
+	} else if (chown != "@") {
+		username = chown
+	}
+	user, err := user.Lookup(username)
+	if err != nil {
+		fmt.Println("Error while chown. Can't find user:", err)
+		return
+	}
+	uid, _ := strconv.Atoi(user.Uid)
+	gid, _ := strconv.Atoi(user.Gid)
+	err = os.Chown(filename, uid, gid)
+	if err != nil {
+		fmt.Println("Error while chown:", err, user)
+	}
+}
+
+func chownAncestorFoldersIfNeeded(basePath, modifiedPath string, username string) {
+	forAllAncestorFolders(basePath, modifiedPath, func(path string) {
+			chownIfNeeded(path, username)
+		})
 }
 
 var FILE_NAME_PATTERN = regexp.MustCompile("/([^/]+)$")
@@ -340,6 +764,17 @@ func contentTypeFilename(filename string) string {
 	return FILE_NAME_PATTERN.ReplaceAllString(filename, "/" + CONTENT_TYPE_FILE_NAME_PREFIX + "$1")    //rsct = RemoteStorageContentType
 }
 
+const META_FILE_NAME_PREFIX = ".rsmd."
+
+func metaFilename(filename string) string {
+	return FILE_NAME_PATTERN.ReplaceAllString(filename, "/" + META_FILE_NAME_PREFIX + "$1")    //rsmd = RemoteStorageMetaData
+}
+
+func isMetaFile(name string) bool {
+	return strings.HasPrefix(name, CONTENT_TYPE_FILE_NAME_PREFIX) || strings.HasPrefix(name, META_FILE_NAME_PREFIX) ||
+		strings.HasPrefix(name, CRYPT_TEMP_FILE_NAME_PREFIX)
+}
+
 func markAncestorFoldersAsModified(basePath, modifiedPath string) {
 	time := time.Now()
 	forAllAncestorFolders(basePath, modifiedPath, func(path string) {
@@ -381,13 +816,6 @@ func exists(path string) (bool, error) {
 	return false, err
 }
 
-func itemName(f os.FileInfo) string {
-	if f.IsDir() {
-		return f.Name() + "/"
-	}
-	return f.Name()
-}
-
 func getUserDataPath(username string) string {
 	return userGorsDir(username) + "data"
 }
@@ -401,40 +829,303 @@ func userGorsDir(username string) string {
 
 /* ------------------------------------ Auth ----------------------------- */
 
-var authorizationByBearer = make(map[string]*Authorization)
+// uniuri.UUIDLen characters have about 119 bits of entropy
+const MIN_TOKEN_LENGTH = uniuri.UUIDLen
+
+const DEFAULT_TOKEN_LENGTH = 32
+
+var tokenLength = DEFAULT_TOKEN_LENGTH
+
+// Only hashes of the tokens are kept (the stored authorizations have no bearerToken), so they can't be used, if they leak.
+var authorizationByTokenHash = make(map[string]*Authorization)
+var authorizationsMutex sync.RWMutex
 var AUTH_PATH = GORS_PATH + "/auth/"
 
 func handleAuth(w http.ResponseWriter, r *http.Request) {
 	username := r.URL.Path[len(AUTH_PATH):]
 	query := r.URL.Query()
-	scopes := parseScopes(query["scope"][0])
-	wrongPassword := false
+	setFrameBustingHeaders(w)
+	w.Header().Set("Cache-Control", "no-store")
+
+	// without a valid redirect_uri of the app we can't tell the app about errors, so we tell the user
+	redirectUri, err := validateRedirectUri(query["redirect_uri"])
+	if err != nil {
+		renderAuthError(w, 400, err.Error())
+		return
+	}
+	clientId, origin, err := validateClientId(query["client_id"], redirectUri)
+	if err != nil {
+		renderAuthError(w, 400, err.Error())
+		return
+	}
+	state, _ := singleParameter(query, "state")
+	if !isValidUsername(username) || len(query["state"]) > 1 {
+		redirectWithAuthError(w, r, redirectUri, "invalid_request", state)
+		return
+	}
+	responseType, _ := singleParameter(query, "response_type")
+	if len(query["response_type"]) > 0 && responseType != "token" && !(responseType == "code" && authCodeFlow) {
+		redirectWithAuthError(w, r, redirectUri, "unsupported_response_type", state)
+		return
+	}
+	codeChallenge, err := validateCodeChallenge(query, responseType)
+	if err != nil {
+		redirectWithAuthError(w, r, redirectUri, "invalid_request", state)
+		return
+	}
+	scopeString, _ := singleParameter(query, "scope")
+	scopes, err := parseScopes(scopeString)
+	if err != nil {
+		redirectWithAuthError(w, r, redirectUri, "invalid_scope", state)
+		return
+	}
+	if !canLogIn(username) {
+		redirectWithAuthError(w, r, redirectUri, "access_denied", state)
+		return
+	}
+	// logged in users don't need to allow access again for the same (or fewer) scopes
+	loggedIn := sessionUsername(r) == username
+	if r.Method != "POST" && loggedIn && hasConsent(username, origin, scopes) {
+		grantAccess(w, r, Authorization{username: username, clientId: clientId, scopes: scopes}, redirectUri, state, codeChallenge)
+		return
+	}
+	loginError := ""
 
 	if (r.Method == "POST") {
-		r.ParseForm()
-		if (isPasswordValid(username, r.Form["password"][0])) {
-			authorization := Authorization{username, query["client_id"][0], scopes, uniuri.NewLen(10)}
-			authorizationByBearer[authorization.bearerToken] = &authorization
-			http.Redirect(w, r , query["redirect_uri"][0] + "#access_token=" + authorization.bearerToken, 301)
+		if !isCsrfTokenValid(r) {
+			renderAuthError(w, 403, "The login form has expired. Please go back to the app and connect again.")
+			return
+		}
+		if r.PostFormValue("deny") != "" {
+			redirectWithAuthError(w, r, redirectUri, "access_denied", state)
+			return
+		}
+		if !loggedIn {
+			loginError = checkLogin(username, r.PostFormValue("password"), r.PostFormValue("otp"))
+		}
+		if (loginError == "") {
+			if !loggedIn {
+				startSession(w, r, username)
+			}
+			if err := addConsent(username, origin, scopes); err != nil {
+				fmt.Println("Error", err)
+			}
+			grantAccess(w, r, Authorization{username: username, clientId: clientId, scopes: scopes}, redirectUri, state, codeChallenge)
 			return
-		} else {
-			wrongPassword = true
 		}
 	}
 
-	t, _ := template.ParseFiles(resourcesPath + "/templates/login.html")
-	t.Execute(w, map[string]interface{} {
+	renderTemplate(w, "login.html", map[string]interface{} {
 			"username": username,
 			"scopes": scopes,
-			"clientID": query["client_id"][0],
-			"wrongPassword": wrongPassword,
+			"clientID": clientId,
+			"origin": origin,
+			"loggedIn": loggedIn,
+			"twoFactor": hasTwoFactor(username),
+			"loginError": loginError,
+			"csrfToken": csrfToken(w, r),
+		})
+}
+
+// grantAccess redirects to the app with a new token (or an authorization code, if a code challenge was sent).
+func grantAccess(w http.ResponseWriter, r *http.Request, grant Authorization, redirectUri string, state string, codeChallenge string) {
+	if codeChallenge != "" {
+		code := newAuthorizationCode(grant, redirectUri, codeChallenge)
+		http.Redirect(w, r, appendResponseParameters(redirectUri, "code=" + url.QueryEscape(code), state, true), redirectStatus(r))
+		return
+	}
+	authorization := newAuthorization(grant.username, grant.clientId, grant.scopes)
+	http.Redirect(w, r, appendResponseParameters(redirectUri, "access_token=" + url.QueryEscape(authorization.bearerToken), state, false), redirectStatus(r))
+}
+
+// redirectStatus returns the status of redirects to the app. After a POST the browser must not post the form again to the app.
+func redirectStatus(r *http.Request) int {
+	if r.Method == "POST" {
+		return 303
+	}
+	return 302
+}
+
+// singleParameter returns the value of a query parameter, which must be given exactly once and not be empty.
+func singleParameter(query url.Values, name string) (string, bool) {
+	if len(query[name]) != 1 || query[name][0] == "" {
+		return "", false
+	}
+	return query[name][0], true
+}
+
+func validateRedirectUri(redirectUris []string) (string, error) {
+	if len(redirectUris) != 1 || redirectUris[0] == "" {
+		return "", errors.New("The app didn't send exactly one redirect_uri.")
+	}
+	redirectUri, err := url.Parse(redirectUris[0])
+	if err != nil || !redirectUri.IsAbs() || redirectUri.Host == "" ||
+			(redirectUri.Scheme != "http" && redirectUri.Scheme != "https") {
+		return "", errors.New("The redirect_uri of the app is not an absolute http(s) URL.")
+	}
+	if redirectUri.Fragment != "" || strings.Contains(redirectUris[0], "#") {
+		return "", errors.New("The redirect_uri of the app must not contain a fragment.")
+	}
+	return redirectUris[0], nil
+}
+
+// validateClientId checks that the redirect_uri belongs to the app identified by the client_id,
+// which is the origin of the app (or only its host for older clients).
+// It returns the client_id and the verified origin.
+func validateClientId(clientIds []string, redirectUri string) (string, string, error) {
+	if len(clientIds) != 1 || clientIds[0] == "" {
+		return "", "", errors.New("The app didn't send exactly one client_id.")
+	}
+	clientId := clientIds[0]
+	parsedRedirectUri, _ := url.Parse(redirectUri)
+	origin := urlOrigin(parsedRedirectUri)
+	if strings.Contains(clientId, "://") {
+		parsedClientId, err := url.Parse(clientId)
+		if err == nil && (parsedClientId.Path == "" || parsedClientId.Path == "/") && parsedClientId.RawQuery == "" &&
+				urlOrigin(parsedClientId) == origin {
+			return clientId, origin, nil
+		}
+	} else if strings.ToLower(clientId) == hostWithoutDefaultPort(parsedRedirectUri) {
+		return clientId, origin, nil
+	}
+	return "", "", errors.New("The redirect_uri " + redirectUri + " doesn't belong to the app " + clientId + ".")
+}
+
+func urlOrigin(u *url.URL) string {
+	return strings.ToLower(u.Scheme) + "://" + hostWithoutDefaultPort(u)
+}
+
+func hostWithoutDefaultPort(u *url.URL) string {
+	host := strings.ToLower(u.Host)
+	if (u.Scheme == "http" && strings.HasSuffix(host, ":80")) || (u.Scheme == "https" && strings.HasSuffix(host, ":443")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+	return host
+}
+
+// redirectWithAuthError tells the app about an error as described in
+// http://tools.ietf.org/html/rfc6749#section-4.2.2.1
+func redirectWithAuthError(w http.ResponseWriter, r *http.Request, redirectUri string, errorCode string, state string) {
+	// the authorization code flow reports errors in the query (http://tools.ietf.org/html/rfc6749#section-4.1.2.1)
+	inQuery := authCodeFlow && r.URL.Query().Get("response_type") == "code"
+	http.Redirect(w, r, appendResponseParameters(redirectUri, "error=" + errorCode, state, inQuery), redirectStatus(r))
+}
+
+// appendResponseParameters appends the parameters (and the state) to the fragment or the query of the redirect_uri.
+func appendResponseParameters(redirectUri string, parameters string, state string, inQuery bool) string {
+	if state != "" {
+		parameters += "&state=" + url.QueryEscape(state)
+	}
+	if !inQuery {
+		return redirectUri + "#" + parameters
+	}
+	if strings.Contains(redirectUri, "?") {
+		return redirectUri + "&" + parameters
+	}
+	return redirectUri + "?" + parameters
+}
+
+func newAuthorization(username string, clientId string, scopes []Scope) *Authorization {
+	if signedTokens {
+		return &Authorization{username, clientId, scopes, newSignedToken(username, clientId, scopes)}
+	}
+	return addAuthorization(Authorization{username, clientId, scopes, uniuri.NewLen(tokenLength)})
+}
+
+// addAuthorization stores the authorization without its token and returns it with token.
+func addAuthorization(authorization Authorization) *Authorization {
+	storedAuthorization := authorization
+	storedAuthorization.bearerToken = ""
+	authorizationsMutex.Lock()
+	defer authorizationsMutex.Unlock()
+	authorizationByTokenHash[hashToken(authorization.bearerToken)] = &storedAuthorization
+	return &authorization
+}
+
+func removeAuthorization(bearerToken string) {
+	authorizationsMutex.Lock()
+	defer authorizationsMutex.Unlock()
+	delete(authorizationByTokenHash, hashToken(bearerToken))
+}
+
+// hashToken hashes random tokens for storage. They have enough entropy, so a fast hash without salt is enough.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func lookupAuthorization(bearerToken string) *Authorization {
+	if signedTokens {
+		if authorization := signedTokenAuthorization(bearerToken); authorization != nil {
+			return authorization
+		}
+	}
+	authorizationsMutex.RLock()
+	defer authorizationsMutex.RUnlock()
+	return authorizationByTokenHash[hashToken(bearerToken)]
+}
+
+// revokeAuthorizations invalidates the tokens of all apps of the user.
+func revokeAuthorizations(username string) error {
+	authorizationsMutex.Lock()
+	for tokenHash, authorization := range authorizationByTokenHash {
+		if authorization.username == username {
+			delete(authorizationByTokenHash, tokenHash)
+		}
+	}
+	authorizationsMutex.Unlock()
+	revokeAuthorizationCodes(username)
+	if signedTokens {
+		return revokeSignedTokens(username)
+	}
+	return nil
+}
+
+func renderAuthError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	renderTemplate(w, "error.html", map[string]interface{} {
+			"message": message,
 		})
 }
 
+func renderTemplate(w http.ResponseWriter, name string, data interface{}) {
+	t, err := template.ParseFiles(resourcesPath + "/templates/" + name)
+	if err != nil {
+		fmt.Println("Error", err)
+		http.Error(w, "Can't load template " + name, 500)
+		return
+	}
+	t.Execute(w, data)
+}
+
+func isValidUsername(username string) bool {
+	return username != "" && username != "." && username != ".." && !strings.Contains(username, "/")
+}
+
+// checkLogin checks the password and (if enrolled) the one-time code of the user and returns an error message ("" if valid).
+func checkLogin(username string, password string, otp string) string {
+	if !isPasswordValid(username, password) {
+		return "Wrong Password. Try again!"
+	}
+	if hasTwoFactor(username) && !isSecondFactorValid(username, otp) {
+		if isSecondFactorLocked(username) {
+			return "Too many wrong one-time codes. Try again in a few minutes!"
+		}
+		return "Wrong one-time code. Try again!"
+	}
+	// users of other authenticators might not have a storage and a .gors folder yet
+	ensureUserStorage(username)
+	ensureUserGorsDir(username)
+	return ""
+}
+
 func isPasswordValid(username string, password string) bool {
-	passwordFileBuf, _ := ioutil.ReadFile(userGorsDir(username) + "password-sha512.txt")
-	expectedPasswordSha1 := strings.Trim(string(passwordFileBuf), " \n")
-	return expectedPasswordSha1 == sha512Sum(password)
+	isValid, err := authenticator.Authenticate(username, password)
+	if err != nil {
+		fmt.Println("Error", err)
+		return false
+	}
+	return isValid
 }
 
 func sha512Sum(s string) string {
@@ -444,31 +1135,79 @@ func sha512Sum(s string) string {
 }
 
 
-func parseScopes(scopesString string) []Scope {
-	scopeStrings := strings.Split(scopesString, " ")
-	scopes := make([]Scope, len(scopeStrings))
-	for i, scopeString := range scopeStrings {
-		parts := strings.Split(scopeString, ":")
-		if (parts[1] == "rw") {
-			scopes[i] = Scope{parts[0], true}
-		} else {
-			scopes[i] = Scope{parts[0], false}
-		}
-	}
-	return scopes
-}
-
 /* ------------------------------------ Webfinger ------------------------ */
 
+const WEBFINGER_PATH = "/.well-known/webfinger"
 
-var RESOURCE_PARA_PATTERN = regexp.MustCompile(`^acct:(.+)@(.+)$`)
+// Older remoteStorage clients ask for this path instead of WEBFINGER_PATH.
+const LEGACY_WEBFINGER_PATH = "/.well-known/host-meta.json"
+
+var RESOURCE_PARA_PATTERN = regexp.MustCompile(`^acct:([^@/]+)@([^@/]+)$`)
+
+// JRD is a JSON Resource Descriptor (RFC 7033).
+type JRD struct {
+	Subject string   `json:"subject"`
+	Aliases []string `json:"aliases,omitempty"`
+	Links   []Link   `json:"links"`
+}
+
+type Link struct {
+	Rel        string                 `json:"rel"`
+	Type       string                 `json:"type,omitempty"`
+	Href       string                 `json:"href,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
 
 func handleWebfinger(w http.ResponseWriter, r *http.Request) {
 	enableCORS(w, r)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Println(r)
-	username := RESOURCE_PARA_PATTERN.FindStringSubmatch(r.URL.Query()["resource"][0])[1]
-	fmt.Fprintf(w, createWebfingerJson(getBaseUrl(r), username))
+
+	if (r.Method == "OPTIONS") {
+		return;
+	}
+
+	query := r.URL.Query()
+	resources := query["resource"]
+	if len(resources) != 1 {
+		http.Error(w, "Exactly one resource parameter is required", 400)
+		return
+	}
+	resourceParts := RESOURCE_PARA_PATTERN.FindStringSubmatch(resources[0])
+	if resourceParts == nil {
+		http.Error(w, "Resource must be an acct URI like acct:user@example.com", 400)
+		return
+	}
+	username := resourceParts[1]
+	baseURL, isServedDomain := getBaseUrlForDomain(r, resourceParts[2])
+	if !isServedDomain {
+		http.Error(w, "Unknown domain", 404)
+		return
+	}
+	if !canLogIn(username) {
+		http.Error(w, "Unknown user", 404)
+		return
+	}
+
+	if r.URL.Path == LEGACY_WEBFINGER_PATH {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/jrd+json")
+	}
+	jrd := createWebfinger(baseURL, resources[0], username)
+	jrd.Links = filterLinksByRel(jrd.Links, query["rel"])
+	json.NewEncoder(w).Encode(jrd)
+}
+
+// getBaseUrlForDomain returns the base URL for a domain in a webfinger resource
+// and whether the domain is served at all. All domains are served if none is configured.
+func getBaseUrlForDomain(r *http.Request, domain string) (string, bool) {
+	if len(domains) == 0 {
+		return getBaseUrl(r), true
+	}
+	baseUrl, isServedDomain := domains[strings.ToLower(domain)]
+	if baseUrl == "" {
+		baseUrl = getBaseUrl(r)
+	}
+	return baseUrl, isServedDomain
 }
 
 func getBaseUrl(r *http.Request) string {
@@ -492,21 +1231,75 @@ func getOwnHost(r *http.Request) string {
 	return r.Host
 }
 
-func createWebfingerJson(baseURL, username string) string {
-	b, _ := json.Marshal(map[string]interface{}{
-		"links": []interface{}{
-			map[string]interface{} {
-				"href": baseURL + STORAGE_PATH + username,
-				"rel": "remoteStorage",
-				"type":"https://www.w3.org/community/rww/wiki/read-write-web-00#simple",
-				"properties": map[string]string{
-					"auth-method": "https://tools.ietf.org/html/draft-ietf-oauth-v2-26#section-4.2",
-					"auth-endpoint":  baseURL + AUTH_PATH + username,
-				},
+// Link relation and properties of newer versions of the remoteStorage spec
+const (
+	REMOTE_STORAGE_REL            = "http://tools.ietf.org/id/draft-dejong-remotestorage"
+	SPEC_VERSION_PROPERTY         = "http://remotestorage.io/spec/version"
+	OAUTH_IMPLICIT_GRANT_PROPERTY = "http://tools.ietf.org/html/rfc6749#section-4.2"
+	QUERY_TOKEN_PROPERTY          = "http://tools.ietf.org/html/rfc6750#section-2.3"
+	RANGE_REQUESTS_PROPERTY       = "http://tools.ietf.org/html/rfc7233"
+	WEB_AUTHORING_PROPERTY        = "http://remotestorage.io/spec/web-authoring"
+)
+
+func createWebfinger(baseURL, subject, username string) *JRD {
+	storageURL := baseURL + STORAGE_PATH + username
+	links := []Link{}
+	if specVersion != "" {
+		properties := map[string]interface{}{
+			SPEC_VERSION_PROPERTY: specVersion,
+			OAUTH_IMPLICIT_GRANT_PROPERTY: baseURL + AUTH_PATH + username,
+			QUERY_TOKEN_PROPERTY: nil,
+			// http.ServeContent handles range requests for documents
+			RANGE_REQUESTS_PROPERTY: "GET",
+			WEB_AUTHORING_PROPERTY: nil,
+		}
+		if queryTokens {
+			properties[QUERY_TOKEN_PROPERTY] = "true"
+		}
+		addAuthCodeFlowProperties(properties, baseURL, username)
+		for key, value := range webfingerProperties {
+			properties[key] = value
+		}
+		links = append(links, Link{Href: storageURL, Rel: REMOTE_STORAGE_REL, Properties: properties})
+	}
+	legacyProperties := map[string]interface{}{
+		"auth-method": "https://tools.ietf.org/html/draft-ietf-oauth-v2-26#section-4.2",
+		"auth-endpoint":  baseURL + AUTH_PATH + username,
+	}
+	// apps must know about query tokens, even if the server doesn't announce a spec version
+	if queryTokens {
+		legacyProperties[QUERY_TOKEN_PROPERTY] = "true"
+	}
+	addAuthCodeFlowProperties(legacyProperties, baseURL, username)
+	return &JRD{
+		Subject: subject,
+		Aliases: []string{storageURL},
+		Links: append(links,
+			Link{
+				Href: storageURL,
+				Rel: "remoteStorage",
+				Type: "https://www.w3.org/community/rww/wiki/read-write-web-00#simple",
+				Properties: legacyProperties,
 			},
-		},
-	})
-	return string(b)
+		),
+	}
+}
+
+// filterLinksByRel keeps only links with one of the requested relation types (all if none is requested).
+func filterLinksByRel(links []Link, rels []string) []Link {
+	if len(rels) == 0 {
+		return links
+	}
+	filteredLinks := []Link{}
+	for _, link := range links {
+		for _, rel := range rels {
+			if link.Rel == rel {
+				filteredLinks = append(filteredLinks, link)
+				break
+			}
+		}
+	}
+	return filteredLinks
 }
 
 /* ------------------------------------ CORS ------------------------ */
@@ -524,4 +1317,5 @@ func enableCORS(w http.ResponseWriter, r *http.Request) {
 	header.Add("access-control-allow-origin", origin)
 	header.Add("access-control-allow-headers", "content-type, authorization, origin")
 	header.Add("access-control-allow-methods", "GET, PUT, DELETE")
+	header.Add("access-control-expose-headers", "www-authenticate")
 }
@@ -1,11 +1,519 @@
 package gors
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"libs/assrt"
 )
 
-func TestScopes(t *testing.T) {
+func webfinger(url string) (*httptest.ResponseRecorder, *JRD) {
+	r, _ := http.NewRequest("GET", url, nil)
+	r.Host = "example.com"
+	w := httptest.NewRecorder()
+	handleWebfinger(w, r)
+	var jrd JRD
+	json.Unmarshal(w.Body.Bytes(), &jrd)
+	return w, &jrd
+}
+
+func withUser1(t *testing.T) func() {
+	done := withTempStorage(t)
+	os.MkdirAll(userGorsDir("user1"), os.ModePerm)
+	return done
+}
+
+func TestWebfinger(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withUser1(t)
+	defer done()
+
+	w, jrd := webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40example.com")
+	assert.Equal(200, w.Code)
+	assert.Equal("application/jrd+json", w.Header().Get("Content-Type"))
+	assert.Equal("acct:user1@example.com", jrd.Subject)
+	assert.Equal([]string{"http://example.com/gors/storage/user1"}, jrd.Aliases)
+	assert.MustEqual(1, len(jrd.Links))
+	assert.Equal("remoteStorage", jrd.Links[0].Rel)
+	assert.Equal("http://example.com/gors/storage/user1", jrd.Links[0].Href)
+	assert.Equal("http://example.com/gors/auth/user1", jrd.Links[0].Properties["auth-endpoint"])
+
+	w, jrd = webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40example.com&rel=remoteStorage&rel=other")
+	assert.Equal(1, len(jrd.Links))
+	w, jrd = webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40example.com&rel=other")
+	assert.Equal(200, w.Code)
+	assert.Equal(0, len(jrd.Links))
+
+	w, jrd = webfinger(LEGACY_WEBFINGER_PATH + "?resource=acct%3Auser1%40example.com")
+	assert.Equal(200, w.Code)
+	assert.Equal("application/json", w.Header().Get("Content-Type"))
+	assert.Equal("remoteStorage", jrd.Links[0].Rel)
+}
+
+func TestWebfingerBadRequests(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withUser1(t)
+	defer done()
+	for _, query := range []string{
+		"",
+		"?resource=",
+		"?resource=user1%40example.com",
+		"?resource=acct%3Auser1",
+		"?resource=acct%3A%40example.com",
+		"?resource=acct%3A..%2Fuser1%40example.com",
+		"?resource=acct%3Auser1%40example.com&resource=acct%3Auser2%40example.com",
+	} {
+		w, _ := webfinger(WEBFINGER_PATH + query)
+		assert.Equal(400, w.Code, query)
+		w, _ = webfinger(LEGACY_WEBFINGER_PATH + query)
+		assert.Equal(400, w.Code, query)
+	}
+}
+
+func TestWebfingerUnknownUserOrDomain(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withUser1(t)
+	defer done()
+
+	w, _ := webfinger(WEBFINGER_PATH + "?resource=acct%3Aunknown%40example.com")
+	assert.Equal(404, w.Code)
+
+	domains = Domains{}
+	defer func() { domains = nil }()
+	domains.Set("Example.com")
+	domains.Set("other.org=https://storage.other.org/")
+
+	w, jrd := webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40example.COM")
+	assert.Equal(200, w.Code)
+	assert.Equal("http://example.com/gors/storage/user1", jrd.Links[0].Href)
+	w, jrd = webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40other.org")
+	assert.Equal(200, w.Code)
+	assert.Equal("https://storage.other.org/gors/storage/user1", jrd.Links[0].Href)
+	assert.Equal("https://storage.other.org/gors/auth/user1", jrd.Links[0].Properties["auth-endpoint"])
+	w, _ = webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40unknown.org")
+	assert.Equal(404, w.Code)
+}
+
+func TestWebfingerWithSpecVersion(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withUser1(t)
+	defer done()
+	specVersion = "draft-dejong-remotestorage-02"
+	webfingerProperties = Properties{}
+	webfingerProperties.Set("http://remotestorage.io/spec/max-size=1000000")
+	defer func() {
+		specVersion = ""
+		webfingerProperties = nil
+	}()
+
+	w, jrd := webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40example.com")
+	assert.Equal(200, w.Code)
+	assert.MustEqual(2, len(jrd.Links))
+	link := jrd.Links[0]
+	assert.Equal(REMOTE_STORAGE_REL, link.Rel)
+	assert.Equal("http://example.com/gors/storage/user1", link.Href)
+	assert.Equal("draft-dejong-remotestorage-02", link.Properties[SPEC_VERSION_PROPERTY])
+	assert.Equal("http://example.com/gors/auth/user1", link.Properties[OAUTH_IMPLICIT_GRANT_PROPERTY])
+	assert.Equal("GET", link.Properties[RANGE_REQUESTS_PROPERTY])
+	assert.Equal("1000000", link.Properties["http://remotestorage.io/spec/max-size"])
+	queryTokenSupport, isAdvertised := link.Properties[QUERY_TOKEN_PROPERTY]
+	assert.True(isAdvertised)
+	assert.Nil(queryTokenSupport)
+	assert.Equal("remoteStorage", jrd.Links[1].Rel)
+
+	_, jrd = webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40example.com&rel=" + REMOTE_STORAGE_REL)
+	assert.Equal(1, len(jrd.Links))
+}
+
+const AUTH_QUERY = "?redirect_uri=https%3A%2F%2Fapp.example.com%2F&client_id=https%3A%2F%2Fapp.example.com&scope=module%3Arw"
+
+func withAuthUser1(t *testing.T) func() {
+	done := withUser1(t)
+	ioutil.WriteFile(userGorsDir("user1") + "password-sha512.txt", []byte(sha512Sum("password") + "\n"), 0600)
+	oldResourcesPath := resourcesPath
+	resourcesPath = ".."
+	return func() {
+		done()
+		resourcesPath = oldResourcesPath
+	}
+}
+
+var CSRF_TOKEN_INPUT_PATTERN = regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`)
+
+// auth posts the login form like a browser, which got the form before.
+func auth(method string, urlString string, password string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", urlString, nil)
+	w := httptest.NewRecorder()
+	handleAuth(w, r)
+	if method != "POST" {
+		return w
+	}
+	form := url.Values{"password": {password}}
+	var cookies []*http.Cookie
+	if match := CSRF_TOKEN_INPUT_PATTERN.FindStringSubmatch(w.Body.String()); match != nil {
+		form.Set(CSRF_TOKEN_FIELD, match[1])
+		cookies = w.Result().Cookies()
+	}
+	return postAuthForm(urlString, form, cookies)
+}
+
+func postAuthForm(urlString string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	return postForm(handleAuth, urlString, form, cookies)
+}
+
+func postForm(handler http.HandlerFunc, urlString string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", urlString, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func getWithCookies(handler http.HandlerFunc, urlString string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", urlString, nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestAuth(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+
+	w := auth("GET", AUTH_PATH + "user1" + AUTH_QUERY, "")
+	assert.Equal(200, w.Code)
+	assert.True(strings.Contains(w.Body.String(), "https://app.example.com"))
+
+	w = auth("POST", AUTH_PATH + "user1" + AUTH_QUERY, "wrong")
+	assert.Equal(200, w.Code)
+	assert.True(strings.Contains(w.Body.String(), "Wrong Password"))
+
+	w = auth("POST", AUTH_PATH + "user1" + AUTH_QUERY + "&state=abc%20def", "password")
+	location := w.Header().Get("Location")
+	assert.True(strings.HasPrefix(location, "https://app.example.com/#access_token="), location)
+	assert.True(strings.HasSuffix(location, "&state=abc+def"), location)
+}
+
+func TestAuthWithInvalidRedirectUri(t *testing.T) {
 	assert := assrt.NewAssert(t)
-	assert.Equal([]Scope{Scope{"name1", true}, Scope{"name2", false}}, parseScopes("name1:rw name2:r"))
+	done := withAuthUser1(t)
+	defer done()
+	for _, query := range []string{
+		"?client_id=app&scope=module%3Arw",
+		"?redirect_uri=&client_id=app.example.com&scope=module%3Arw",
+		"?redirect_uri=%2Frelative&client_id=app.example.com&scope=module%3Arw",
+		"?redirect_uri=javascript%3Aalert(1)&client_id=app.example.com&scope=module%3Arw",
+		"?redirect_uri=https%3A%2F%2F&client_id=app.example.com&scope=module%3Arw",
+		"?redirect_uri=https%3A%2F%2Fapp.example.com%2F%23fragment&client_id=app.example.com&scope=module%3Arw",
+		"?redirect_uri=https%3A%2F%2Fapp.example.com%2F&redirect_uri=https%3A%2F%2Fevil.example.com%2F&client_id=app.example.com&scope=module%3Arw",
+		"?redirect_uri=%25zz&client_id=app.example.com&scope=module%3Arw",
+		"?redirect_uri=https%3A%2F%2Fapp.example.com%2F&scope=module%3Arw",
+		"?redirect_uri=https%3A%2F%2Fapp.example.com%2F&client_id=&scope=module%3Arw",
+		"?redirect_uri=https%3A%2F%2Fapp.example.com%2F&client_id=app.example.com&client_id=evil.example.com&scope=module%3Arw",
+	} {
+		for _, method := range []string{"GET", "POST"} {
+			w := auth(method, AUTH_PATH + "user1" + query, "password")
+			assert.Equal(400, w.Code, query)
+			assert.Equal("", w.Header().Get("Location"), query)
+			assert.True(strings.Contains(w.Body.String(), "errorMessage"), query)
+		}
+	}
+}
+
+func TestAuthErrorRedirects(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+	redirectUri := "https%3A%2F%2Fapp.example.com%2F"
+	for _, test := range []struct {
+		path  string
+		query string
+		error string
+	}{
+		{"user1", "&client_id=app.example.com&scope=module%3Arw&state=1&state=2", "invalid_request"},
+		{"", "&client_id=app.example.com&scope=module%3Arw", "invalid_request"},
+		{"..", "&client_id=app.example.com&scope=module%3Arw", "invalid_request"},
+		{"user1/module", "&client_id=app.example.com&scope=module%3Arw", "invalid_request"},
+		{"user1", "&client_id=app.example.com&scope=module%3Arw&response_type=code", "unsupported_response_type"},
+		{"user1", "&client_id=app.example.com&scope=module%3Arw&response_type=", "unsupported_response_type"},
+		{"user1", "&client_id=app.example.com", "invalid_scope"},
+		{"user1", "&client_id=app.example.com&scope=", "invalid_scope"},
+		{"user1", "&client_id=app.example.com&scope=module", "invalid_scope"},
+		{"user1", "&client_id=app.example.com&scope=%3Arw", "invalid_scope"},
+		{"user1", "&client_id=app.example.com&scope=module%3Arw%3Ax", "invalid_scope"},
+		{"user1", "&client_id=app.example.com&scope=module%3Arw&scope=other%3Ar", "invalid_scope"},
+		{"unknown", "&client_id=app.example.com&scope=module%3Arw", "access_denied"},
+	} {
+		for _, method := range []string{"GET", "POST"} {
+			w := auth(method, AUTH_PATH + test.path + "?redirect_uri=" + redirectUri + test.query, "password")
+			expectedStatus := 302
+			if method == "POST" {
+				expectedStatus = 303
+			}
+			assert.Equal(expectedStatus, w.Code, test.path + test.query)
+			assert.Equal("https://app.example.com/#error=" + test.error, w.Header().Get("Location"), test.path + test.query)
+		}
+	}
+
+	w := auth("GET", AUTH_PATH + "unknown?redirect_uri=" + redirectUri + "&client_id=app.example.com&scope=module%3Arw&state=xyz", "")
+	assert.Equal("https://app.example.com/#error=access_denied&state=xyz", w.Header().Get("Location"))
+}
+
+func TestAuthClientIdMustMatchRedirectUri(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+	for _, test := range []struct {
+		redirectUri string
+		clientId    string
+		valid       bool
+	}{
+		{"https://app.example.com/", "https://app.example.com", true},
+		{"https://app.example.com/app/index.html?x=1", "https://app.example.com/", true},
+		{"https://App.Example.com:443/", "https://app.example.com", true},
+		{"http://app.example.com:8000/", "http://app.example.com:8000", true},
+		{"https://app.example.com/", "app.example.com", true},
+		{"http://app.example.com:8000/", "app.example.com:8000", true},
+		{"https://evil.example.com/", "https://app.example.com", false},
+		{"https://app.example.com.evil.org/", "https://app.example.com", false},
+		{"http://app.example.com/", "https://app.example.com", false},
+		{"https://app.example.com:8443/", "https://app.example.com", false},
+		{"https://app.example.com/", "https://app.example.com/other", false},
+		{"https://evil.example.com/", "app.example.com", false},
+		{"https://app.example.com:8443/", "app.example.com", false},
+	} {
+		query := url.Values{"redirect_uri": {test.redirectUri}, "client_id": {test.clientId}, "scope": {"module:rw"}}
+		w := auth("GET", AUTH_PATH + "user1?" + query.Encode(), "")
+		if test.valid {
+			assert.Equal(200, w.Code, test)
+		} else {
+			assert.Equal(400, w.Code, test)
+			assert.Equal("", w.Header().Get("Location"), test)
+			assert.True(strings.Contains(w.Body.String(), "doesn&#39;t belong to the app"), test)
+		}
+	}
+
+	w := auth("GET", AUTH_PATH + "user1?redirect_uri=https%3A%2F%2Fapp.example.com%3A443%2Fapp%2F&client_id=app.example.com&scope=module%3Arw", "")
+	assert.True(strings.Contains(w.Body.String(), "<strong>https://app.example.com</strong>"))
+}
+
+func TestAuthCsrfProtection(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+
+	w := auth("GET", AUTH_PATH + "user1" + AUTH_QUERY, "")
+	assert.Equal("DENY", w.Header().Get("X-Frame-Options"))
+	assert.Equal("frame-ancestors 'none'", w.Header().Get("Content-Security-Policy"))
+	assert.Equal("no-store", w.Header().Get("Cache-Control"))
+	cookies := w.Result().Cookies()
+	assert.MustEqual(1, len(cookies))
+	assert.Equal(CSRF_COOKIE_NAME, cookies[0].Name)
+	assert.True(cookies[0].HttpOnly)
+	match := CSRF_TOKEN_INPUT_PATTERN.FindStringSubmatch(w.Body.String())
+	assert.MustNotNil(match)
+	token := match[1]
+
+	otherCookies := []*http.Cookie{&http.Cookie{Name: CSRF_COOKIE_NAME, Value: "other"}}
+	otherQuery := strings.Replace(AUTH_QUERY, "module%3Arw", "other%3Arw", 1)
+	for _, test := range []struct {
+		url     string
+		token   string
+		cookies []*http.Cookie
+	}{
+		{AUTH_PATH + "user1" + AUTH_QUERY, "", cookies},
+		{AUTH_PATH + "user1" + AUTH_QUERY, token, nil},
+		{AUTH_PATH + "user1" + AUTH_QUERY, token, otherCookies},
+		{AUTH_PATH + "user1" + AUTH_QUERY, token + "0", cookies},
+		{AUTH_PATH + "user1" + otherQuery, token, cookies},
+	} {
+		w := postAuthForm(test.url, url.Values{"password": {"password"}, CSRF_TOKEN_FIELD: {test.token}}, test.cookies)
+		assert.Equal(403, w.Code, test)
+		assert.Equal("", w.Header().Get("Location"), test)
+	}
+
+	w = postAuthForm(AUTH_PATH + "user1" + AUTH_QUERY, url.Values{"password": {"password"}, CSRF_TOKEN_FIELD: {token}}, cookies)
+	assert.Equal(303, w.Code)
+	assert.True(strings.HasPrefix(w.Header().Get("Location"), "https://app.example.com/#access_token="))
+	for _, cookie := range w.Result().Cookies() {
+		assert.True(cookie.Name != CSRF_COOKIE_NAME)
+	}
+}
+
+func TestAuthDeny(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+	tokens := len(authorizationByTokenHash)
+
+	w := auth("GET", AUTH_PATH + "user1" + AUTH_QUERY + "&state=42", "")
+	assert.True(strings.Contains(w.Body.String(), `name="deny"`))
+	match := CSRF_TOKEN_INPUT_PATTERN.FindStringSubmatch(w.Body.String())
+	assert.MustNotNil(match)
+	w = postAuthForm(AUTH_PATH + "user1" + AUTH_QUERY + "&state=42", url.Values{"deny": {"Deny"}, CSRF_TOKEN_FIELD: {match[1]}}, w.Result().Cookies())
+	assert.Equal(303, w.Code)
+	assert.Equal("https://app.example.com/#error=access_denied&state=42", w.Header().Get("Location"))
+	assert.Equal(tokens, len(authorizationByTokenHash))
+}
+
+func TestTokensAreStoredAsHashes(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withUser1(t)
+	defer done()
+
+	authorization := newAuthorization("user1", "example.com", []Scope{Scope{"module", true}})
+	defer removeAuthorization(authorization.bearerToken)
+	assert.Equal(DEFAULT_TOKEN_LENGTH, len(authorization.bearerToken))
+	assert.Nil(authorizationByTokenHash[authorization.bearerToken])
+	storedAuthorization := authorizationByTokenHash[hashToken(authorization.bearerToken)]
+	assert.MustNotNil(storedAuthorization)
+	assert.Equal("", storedAuthorization.bearerToken)
+	assert.True(lookupAuthorization(authorization.bearerToken) == storedAuthorization)
+
+	tokenLength = MIN_TOKEN_LENGTH
+	defer func() { tokenLength = DEFAULT_TOKEN_LENGTH }()
+	shortAuthorization := newAuthorization("user1", "example.com", []Scope{Scope{"module", true}})
+	defer removeAuthorization(shortAuthorization.bearerToken)
+	assert.Equal(MIN_TOKEN_LENGTH, len(shortAuthorization.bearerToken))
+	assert.NotNil(lookupAuthorization(shortAuthorization.bearerToken))
+}
+
+func TestConcurrentAuthorizations(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withUser1(t)
+	defer done()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			authorization := newAuthorization("user2", "example.com", []Scope{Scope{"module", true}})
+			lookupAuthorization(authorization.bearerToken)
+			removeAuthorization(authorization.bearerToken)
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			revokeAuthorizations("user2")
+		}()
+	}
+	wg.Wait()
+	authorization := newAuthorization("user2", "example.com", nil)
+	assert.NotNil(lookupAuthorization(authorization.bearerToken))
+	assert.MustNil(revokeAuthorizations("user2"))
+	assert.Nil(lookupAuthorization(authorization.bearerToken))
+}
+
+func TestQueryTokens(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withUser1(t)
+	defer done()
+	w := httptest.NewRecorder()
+	handleStorage(w, requestWithToken("PUT", STORAGE_PATH + "user1/module/image.png", "png", "fs-token"))
+	assert.Equal(200, w.Code)
+
+	get := func(url string, token string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", url, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer " + token)
+		}
+		w := httptest.NewRecorder()
+		handleStorage(w, r)
+		return w
+	}
+	w = get(STORAGE_PATH + "user1/module/image.png?access_token=fs-token", "")
+	assert.Equal(401, w.Code)
+
+	queryTokens = true
+	defer func() { queryTokens = false }()
+	w = get(STORAGE_PATH + "user1/module/image.png?access_token=fs-token", "")
+	assert.Equal(200, w.Code)
+	assert.Equal("png", w.Body.String())
+	assert.Equal("private", w.Header().Get("Cache-Control"))
+	w = get(STORAGE_PATH + "user1/module/image.png?access_token=wrong", "")
+	assert.Equal(401, w.Code)
+	w = get(STORAGE_PATH + "user1/module/image.png?access_token=fs-token&access_token=fs-token", "")
+	assert.Equal(400, w.Code)
+	w = get(STORAGE_PATH + "user1/module/image.png?access_token=fs-token", "fs-token")
+	assert.Equal(400, w.Code)
+
+	r := httptest.NewRequest("DELETE", STORAGE_PATH + "user1/module/image.png?access_token=fs-token", nil)
+	w = httptest.NewRecorder()
+	handleStorage(w, r)
+	assert.Equal(401, w.Code)
+
+	r = httptest.NewRequest("GET", STORAGE_PATH + "user1/module/image.png?v=1&access_token=fs-token", nil)
+	assert.True(takeQueryToken(httptest.NewRecorder(), r))
+	assert.Equal("v=1", r.URL.RawQuery)
+	assert.Equal(STORAGE_PATH + "user1/module/image.png?v=1", r.RequestURI)
+	assert.Equal("Bearer fs-token", r.Header.Get("Authorization"))
+
+	// the default config has no spec version, so there is only the legacy link
+	_, jrd := webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40example.com")
+	assert.MustEqual(1, len(jrd.Links))
+	assert.Equal("true", jrd.Links[0].Properties[QUERY_TOKEN_PROPERTY])
+
+	specVersion = "draft-dejong-remotestorage-02"
+	defer func() { specVersion = "" }()
+	_, jrd = webfinger(WEBFINGER_PATH + "?resource=acct%3Auser1%40example.com")
+	assert.Equal("true", jrd.Links[0].Properties[QUERY_TOKEN_PROPERTY])
+	assert.Equal("true", jrd.Links[1].Properties[QUERY_TOKEN_PROPERTY])
+}
+
+func TestBearerChallenges(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withUser1(t)
+	defer done()
+
+	for _, test := range []struct {
+		method        string
+		path          string
+		authorization []string
+		status        int
+		challenge     string
+	}{
+		{"GET", "module/", nil, 401, `Bearer scope="module:r"`},
+		{"GET", "module/", []string{"Basic dXNlcjE6cGFzc3dvcmQ="}, 401, `Bearer scope="module:r"`},
+		{"GET", "module/", []string{"Bearer"}, 400, `Bearer error="invalid_request", scope="module:r"`},
+		{"GET", "module/", []string{"Bearer fs token"}, 400, `Bearer error="invalid_request", scope="module:r"`},
+		{"GET", "module/", []string{"Bearer fs-token", "Bearer fs-token"}, 400, `Bearer error="invalid_request", scope="module:r"`},
+		{"GET", "module/", []string{"Bearer unknown-token"}, 401, `Bearer error="invalid_token", scope="module:r"`},
+		{"PUT", "other/file.txt", []string{"Bearer fs-token"}, 403, `Bearer error="insufficient_scope", scope="other:rw"`},
+		{"GET", "public/other/file.txt", []string{"Bearer fs-token"}, 404, ""},
+		{"GET", "public/other/", []string{"Bearer fs-token"}, 403, `Bearer error="insufficient_scope", scope="other:r"`},
+		{"GET", "", []string{"Bearer fs-token"}, 403, `Bearer error="insufficient_scope", scope="root:r"`},
+		{"GET", "module/", []string{"bearer fs-token"}, 404, ""},
+		{"GET", "module/", []string{"BEARER  fs-token"}, 404, ""},
+	} {
+		r, _ := http.NewRequest(test.method, STORAGE_PATH + "user1/" + test.path, strings.NewReader("text"))
+		r.Header["Authorization"] = test.authorization
+		w := httptest.NewRecorder()
+		handleStorage(w, r)
+		assert.Equal(test.status, w.Code, test)
+		assert.Equal(test.challenge, w.Header().Get("WWW-Authenticate"), test)
+	}
+
+	r, _ := http.NewRequest("GET", STORAGE_PATH + "user2/module/", nil)
+	r.Header.Set("Authorization", "Bearer fs-token")
+	w := httptest.NewRecorder()
+	handleStorage(w, r)
+	assert.Equal(401, w.Code)
+	assert.Equal(`Bearer error="invalid_token", scope="module:r"`, w.Header().Get("WWW-Authenticate"))
 }
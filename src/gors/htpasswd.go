@@ -0,0 +1,181 @@
+package gors
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"libs/bcrypt"
+)
+
+/* ------------------------------------ htpasswd Authenticator ----------------------------- */
+
+// htpasswdAuthenticator checks passwords against an Apache htpasswd file with bcrypt,
+// SHA or APR1-MD5 entries. The file is read again when it changes.
+
+type htpasswdAuthenticator struct {
+	filename string
+	mutex    sync.Mutex
+	// modification time and size of the loaded file
+	modTime  time.Time
+	size     int64
+	hashes   map[string]string
+}
+
+func newHtpasswdAuthenticator(filename string) (*htpasswdAuthenticator, error) {
+	a := &htpasswdAuthenticator{filename: filename}
+	if _, err := a.userHash(""); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *htpasswdAuthenticator) Authenticate(username string, password string) (bool, error) {
+	hash, err := a.userHash(username)
+	if err != nil || hash == "" {
+		return false, err
+	}
+	return isHtpasswdHashValid(hash, password)
+}
+
+func (a *htpasswdAuthenticator) UserExists(username string) bool {
+	hash, err := a.userHash(username)
+	if err != nil {
+		fmt.Println("Error", err)
+	}
+	return hash != ""
+}
+
+// userHash returns the password hash of the user ("" for unknown users) and reloads the file if needed.
+func (a *htpasswdAuthenticator) userHash(username string) (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	fInfo, err := os.Stat(a.filename)
+	if err != nil {
+		return "", err
+	}
+	if a.hashes == nil || !fInfo.ModTime().Equal(a.modTime) || fInfo.Size() != a.size {
+		hashes, err := readHtpasswdFile(a.filename)
+		if err != nil {
+			return "", err
+		}
+		a.hashes, a.modTime, a.size = hashes, fInfo.ModTime(), fInfo.Size()
+	}
+	return a.hashes[username], nil
+}
+
+func readHtpasswdFile(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			hashes[parts[0]] = parts[1]
+		}
+	}
+	return hashes, scanner.Err()
+}
+
+func isHtpasswdHashValid(hash string, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return constantTimeEquals(hash[len("{SHA}"):], base64.StdEncoding.EncodeToString(sum[:])), nil
+	case strings.HasPrefix(hash, APR1_MAGIC):
+		salt := strings.SplitN(hash[len(APR1_MAGIC):], "$", 2)[0]
+		return constantTimeEquals(hash, apr1Hash(password, salt)), nil
+	}
+	return false, errors.New("Unsupported htpasswd hash (use bcrypt, SHA or MD5)")
+}
+
+func constantTimeEquals(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+/* ---- APR1-MD5 ---- */
+
+const APR1_MAGIC = "$apr1$"
+
+const APR1_ALPHABET = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Hash computes the Apache variant of the MD5 based crypt of FreeBSD.
+func apr1Hash(password string, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	alternate := md5.Sum([]byte(password + salt + password))
+	hash := md5.New()
+	hash.Write([]byte(password + APR1_MAGIC + salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			hash.Write(alternate[:])
+		} else {
+			hash.Write(alternate[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i & 1 != 0 {
+			hash.Write([]byte{0})
+		} else {
+			hash.Write([]byte(password[:1]))
+		}
+	}
+	final := hash.Sum(nil)
+
+	// slow down brute force attacks
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i & 1 != 0 {
+			round.Write([]byte(password))
+		} else {
+			round.Write(final)
+		}
+		if i % 3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i % 7 != 0 {
+			round.Write([]byte(password))
+		}
+		if i & 1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write([]byte(password))
+		}
+		final = round.Sum(nil)
+	}
+
+	encoded := make([]byte, 0, 22)
+	encode := func(value uint, chars int) {
+		for ; chars > 0; chars-- {
+			encoded = append(encoded, APR1_ALPHABET[value & 0x3f])
+			value >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[group[0]]) << 16 | uint(final[group[1]]) << 8 | uint(final[group[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return APR1_MAGIC + salt + "$" + string(encoded)
+}
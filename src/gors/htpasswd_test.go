@@ -0,0 +1,84 @@
+package gors
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"libs/assrt"
+	"libs/bcrypt"
+)
+
+func TestApr1Hash(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	// created with openssl passwd -apr1
+	assert.Equal("$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1", apr1Hash("password", "abcdefgh"))
+	assert.Equal("$apr1$xy$2kxsM.KSUR67SxBD36Rpa1", apr1Hash("a much longer password than sixteen chars", "xy"))
+	assert.Equal("$apr1$12345678$sHuPAw7VA9xjRbJz7zKV7/", apr1Hash("", "12345678"))
+}
+
+func TestHtpasswdHashes(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	for _, hash := range []string{
+		string(bcryptHash),
+		// Apache writes $2y$
+		"$2y$" + string(bcryptHash[4:]),
+		"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1",
+	} {
+		isValid, err := isHtpasswdHashValid(hash, "password")
+		assert.Nil(err, hash)
+		assert.True(isValid, hash)
+		isValid, err = isHtpasswdHashValid(hash, "wrong")
+		assert.Nil(err, hash)
+		assert.True(!isValid, hash)
+	}
+
+	_, err := isHtpasswdHashValid("password", "password")
+	assert.NotNil(err)
+	_, err = isHtpasswdHashValid("$2y$05$short", "password")
+	assert.NotNil(err)
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+
+	filename := dataPath + "/htpasswd"
+	ioutil.WriteFile(filename, []byte("# users\n\nproxyuser:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\nother:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1\n"), 0600)
+	htpasswd, err := newHtpasswdAuthenticator(filename)
+	assert.MustNil(err)
+	authenticator = htpasswd
+	defer func() { authenticator = passwordFileAuthenticator{} }()
+
+	assert.True(userExists("proxyuser"))
+	assert.True(!userExists("user1"))
+	assert.True(!userExists("# users"))
+	isValid, err := authenticator.Authenticate("proxyuser", "password")
+	assert.Nil(err)
+	assert.True(isValid)
+	isValid, _ = authenticator.Authenticate("unknown", "password")
+	assert.True(!isValid)
+
+	// changes of the file are noticed
+	ioutil.WriteFile(filename, []byte("proxyuser:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1\nnewuser:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(filename, later, later)
+	assert.True(userExists("newuser"))
+	assert.True(!userExists("other"))
+	isValid, _ = authenticator.Authenticate("proxyuser", "password")
+	assert.True(isValid)
+
+	w := auth("POST", AUTH_PATH + "newuser" + AUTH_QUERY, "password")
+	assert.Equal(303, w.Code)
+	assert.True(strings.HasPrefix(w.Header().Get("Location"), "https://app.example.com/#access_token="))
+
+	os.Remove(filename)
+	_, err = authenticator.Authenticate("proxyuser", "password")
+	assert.NotNil(err)
+	_, err = newHtpasswdAuthenticator(filename)
+	assert.NotNil(err)
+}
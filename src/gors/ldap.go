@@ -0,0 +1,250 @@
+package gors
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ------------------------------------ LDAP Authenticator ----------------------------- */
+
+// ldapAuthenticator checks passwords by a simple bind (RFC 4511) with the DN of the user.
+// Only the bind and unbind operations are needed, so they are encoded here directly in BER.
+
+type LDAPConfig struct {
+	// Url like ldap://ldap.example.com or ldaps://ldap.example.com:636
+	Url    string
+	// UserDN is the DN of the users with %s for the username, like uid=%s,ou=people,dc=example,dc=com
+	UserDN string
+}
+
+const LDAP_TIMEOUT = 10 * time.Second
+
+// BER tags of the used LDAP messages
+const (
+	BER_SEQUENCE        = 0x30
+	BER_INTEGER         = 0x02
+	BER_OCTET_STRING    = 0x04
+	BER_ENUMERATED      = 0x0a
+	LDAP_BIND_REQUEST   = 0x60
+	LDAP_BIND_RESPONSE  = 0x61
+	LDAP_UNBIND_REQUEST = 0x42
+	LDAP_SIMPLE_AUTH    = 0x80
+)
+
+// LDAP result codes
+const (
+	LDAP_SUCCESS             = 0
+	LDAP_INVALID_CREDENTIALS = 49
+)
+
+// Longer responses are not expected for a bind.
+const MAX_BER_LENGTH = 1 << 16
+
+type ldapAuthenticator struct {
+	config LDAPConfig
+}
+
+func (a ldapAuthenticator) Authenticate(username string, password string) (bool, error) {
+	// a bind without password is an anonymous bind, which would succeed
+	if password == "" {
+		return false, nil
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(LDAP_TIMEOUT))
+
+	dn := strings.Replace(a.config.UserDN, "%s", escapeDNValue(username), -1)
+	bindRequest := berElement(LDAP_BIND_REQUEST, concat(
+		berInteger(3),
+		berElement(BER_OCTET_STRING, []byte(dn)),
+		berElement(LDAP_SIMPLE_AUTH, []byte(password))))
+	if _, err := conn.Write(berElement(BER_SEQUENCE, concat(berInteger(1), bindRequest))); err != nil {
+		return false, err
+	}
+
+	resultCode, diagnosticMessage, err := readBindResponse(bufio.NewReader(conn))
+	if err != nil {
+		return false, err
+	}
+	conn.Write(berElement(BER_SEQUENCE, concat(berInteger(2), []byte{LDAP_UNBIND_REQUEST, 0})))
+	switch resultCode {
+	case LDAP_SUCCESS:
+		return true, nil
+	case LDAP_INVALID_CREDENTIALS:
+		return false, nil
+	}
+	return false, fmt.Errorf("LDAP bind failed with result code %d: %s", resultCode, diagnosticMessage)
+}
+
+// UserExists can't ask the directory without credentials, so only users with a storage exist.
+// Other users of the directory still get the login form (see canLogIn).
+func (a ldapAuthenticator) UserExists(username string) bool {
+	existData, _ := exists(getUserDataPath(username))
+	return existData
+}
+
+func (a ldapAuthenticator) dial() (net.Conn, error) {
+	ldapUrl, err := url.Parse(a.config.Url)
+	if err != nil {
+		return nil, err
+	}
+	host := ldapUrl.Host
+	switch ldapUrl.Scheme {
+	case "ldap":
+		if ldapUrl.Port() == "" {
+			host += ":389"
+		}
+		return net.DialTimeout("tcp", host, LDAP_TIMEOUT)
+	case "ldaps":
+		if ldapUrl.Port() == "" {
+			host += ":636"
+		}
+		dialer := &net.Dialer{Timeout: LDAP_TIMEOUT}
+		return tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: ldapUrl.Hostname()})
+	}
+	return nil, errors.New("Unsupported LDAP URL: " + a.config.Url)
+}
+
+func readBindResponse(reader *bufio.Reader) (int, string, error) {
+	tag, message, err := readBerElement(reader)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != BER_SEQUENCE {
+		return 0, "", errors.New("Invalid LDAP message")
+	}
+	elements, err := parseBerElements(message)
+	if err != nil || len(elements) < 2 || elements[1].tag != LDAP_BIND_RESPONSE {
+		return 0, "", errors.New("Unexpected LDAP response")
+	}
+	result, err := parseBerElements(elements[1].content)
+	if err != nil || len(result) < 3 || result[0].tag != BER_ENUMERATED {
+		return 0, "", errors.New("Invalid LDAP bind response")
+	}
+	return int(parseBerInteger(result[0].content)), string(result[2].content), nil
+}
+
+/* ---- BER ---- */
+
+type berValue struct {
+	tag     byte
+	content []byte
+}
+
+func berElement(tag byte, content []byte) []byte {
+	return concat([]byte{tag}, berLength(len(content)), content)
+}
+
+func berLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+	var bytes []byte
+	for ; length > 0; length >>= 8 {
+		bytes = append([]byte{byte(length)}, bytes...)
+	}
+	return append([]byte{0x80 | byte(len(bytes))}, bytes...)
+}
+
+func berInteger(value int) []byte {
+	bytes := []byte{byte(value)}
+	for value >>= 8; value > 0; value >>= 8 {
+		bytes = append([]byte{byte(value)}, bytes...)
+	}
+	if bytes[0] & 0x80 != 0 {
+		bytes = append([]byte{0}, bytes...)
+	}
+	return berElement(BER_INTEGER, bytes)
+}
+
+func parseBerInteger(content []byte) int64 {
+	var value int64
+	for i, b := range content {
+		if i == 0 && b & 0x80 != 0 {
+			value = -1
+		}
+		value = value << 8 | int64(b)
+	}
+	return value
+}
+
+func readBerElement(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1])
+	if length & 0x80 != 0 {
+		lengthBytes := make([]byte, length & 0x7f)
+		if len(lengthBytes) == 0 || len(lengthBytes) > 4 {
+			return 0, nil, errors.New("Unsupported BER length")
+		}
+		if _, err := io.ReadFull(reader, lengthBytes); err != nil {
+			return 0, nil, err
+		}
+		length = 0
+		for _, b := range lengthBytes {
+			length = length << 8 | int(b)
+		}
+	}
+	if length > MAX_BER_LENGTH {
+		return 0, nil, errors.New("BER element is too long: " + strconv.Itoa(length))
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return 0, nil, err
+	}
+	return header[0], content, nil
+}
+
+func parseBerElements(content []byte) ([]berValue, error) {
+	var values []berValue
+	reader := strings.NewReader(string(content))
+	for reader.Len() > 0 {
+		tag, elementContent, err := readBerElement(reader)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, berValue{tag, elementContent})
+	}
+	return values, nil
+}
+
+func concat(parts ...[]byte) []byte {
+	var result []byte
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
+
+// escapeDNValue escapes special characters of an attribute value in a DN (RFC 4514).
+func escapeDNValue(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(",+\"\\<>;=", c) >= 0,
+				c == '#' && i == 0,
+				c == ' ' && (i == 0 || i == len(value) - 1):
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		case c == 0:
+			escaped.WriteString("\\00")
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
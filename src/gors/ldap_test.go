@@ -0,0 +1,180 @@
+package gors
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"libs/assrt"
+)
+
+// fakeLDAP is an in-process stand-in for an LDAP server, which answers simple binds.
+type fakeLDAP struct {
+	listener  net.Listener
+	passwords map[string]string
+	mutex     sync.Mutex
+	binds     int
+}
+
+func newFakeLDAP(t *testing.T, passwords map[string]string) *fakeLDAP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeLDAP{listener: listener, passwords: passwords}
+	go server.serve()
+	return server
+}
+
+func (s *fakeLDAP) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.handle(conn)
+	}
+}
+
+func (s *fakeLDAP) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		_, message, err := readBerElement(reader)
+		if err != nil {
+			return
+		}
+		elements, _ := parseBerElements(message)
+		if len(elements) < 2 || elements[1].tag != LDAP_BIND_REQUEST {
+			return
+		}
+		bind, _ := parseBerElements(elements[1].content)
+		dn, password := string(bind[1].content), string(bind[2].content)
+		s.mutex.Lock()
+		s.binds++
+		s.mutex.Unlock()
+		resultCode := LDAP_INVALID_CREDENTIALS
+		if expected, isKnown := s.passwords[dn]; isKnown && expected == password {
+			resultCode = LDAP_SUCCESS
+		}
+		if dn == "uid=broken,ou=people,dc=example,dc=com" {
+			resultCode = 52
+		}
+		bindResponse := berElement(LDAP_BIND_RESPONSE, concat(
+			berElement(BER_ENUMERATED, []byte{byte(resultCode)}),
+			berElement(BER_OCTET_STRING, nil),
+			berElement(BER_OCTET_STRING, []byte("diagnostic"))))
+		conn.Write(berElement(BER_SEQUENCE, concat(berElement(BER_INTEGER, elements[0].content), bindResponse)))
+	}
+}
+
+func withLDAP(t *testing.T) (*fakeLDAP, func()) {
+	done := withAuthUser1(t)
+	server := newFakeLDAP(t, map[string]string{
+		"uid=ldapuser,ou=people,dc=example,dc=com": "ldap-password",
+		"uid=user\\,x,ou=people,dc=example,dc=com": "escaped",
+	})
+	authenticator = ldapAuthenticator{LDAPConfig{"ldap://" + server.listener.Addr().String(), "uid=%s,ou=people,dc=example,dc=com"}}
+	return server, func() {
+		done()
+		server.listener.Close()
+		authenticator = passwordFileAuthenticator{}
+	}
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	server, done := withLDAP(t)
+	defer done()
+
+	isValid, err := authenticator.Authenticate("ldapuser", "ldap-password")
+	assert.Nil(err)
+	assert.True(isValid)
+	isValid, err = authenticator.Authenticate("ldapuser", "wrong")
+	assert.Nil(err)
+	assert.True(!isValid)
+	isValid, err = authenticator.Authenticate("user,x", "escaped")
+	assert.Nil(err)
+	assert.True(isValid)
+
+	// anonymous binds are never tried
+	server.mutex.Lock()
+	binds := server.binds
+	server.mutex.Unlock()
+	isValid, err = authenticator.Authenticate("ldapuser", "")
+	assert.True(!isValid)
+	server.mutex.Lock()
+	assert.Equal(binds, server.binds)
+	server.mutex.Unlock()
+
+	_, err = authenticator.Authenticate("broken", "password")
+	assert.NotNil(err)
+
+	authenticator = ldapAuthenticator{LDAPConfig{"http://" + server.listener.Addr().String(), "uid=%s"}}
+	_, err = authenticator.Authenticate("ldapuser", "ldap-password")
+	assert.NotNil(err)
+}
+
+func TestLoginWithLDAP(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	_, done := withLDAP(t)
+	defer done()
+
+	// LDAP users don't need a storage before their first login
+	query := AUTH_QUERY
+	w, _ := webfinger(WEBFINGER_PATH + "?resource=acct%3Aldapuser%40example.com")
+	assert.Equal(200, w.Code)
+	w = auth("POST", AUTH_PATH + "ldapuser" + query, "wrong")
+	assert.True(strings.Contains(w.Body.String(), "Wrong Password"))
+	assert.True(!userExists("ldapuser"))
+	existGorsDir, _ := exists(userGorsDir("ldapuser"))
+	assert.True(!existGorsDir)
+
+	w = auth("POST", AUTH_PATH + "ldapuser" + query, "ldap-password")
+	assert.Equal(303, w.Code)
+	assert.True(strings.HasPrefix(w.Header().Get("Location"), "https://app.example.com/#access_token="))
+	assert.True(userExists("ldapuser"))
+	existData, _ := exists(getUserDataPath("ldapuser"))
+	assert.True(existData)
+	consents, _ := readConsents("ldapuser")
+	assert.Equal("module:rw", consents["https://app.example.com"])
+
+	// the password file of user1 is ignored
+	w = auth("POST", AUTH_PATH + "user1" + query, "password")
+	assert.True(strings.Contains(w.Body.String(), "Wrong Password"))
+
+	w = auth("GET", AUTH_PATH + ".." + query, "")
+	assert.Equal("https://app.example.com/#error=invalid_request", w.Header().Get("Location"))
+}
+
+func TestEscapeDNValue(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	assert.Equal("user1", escapeDNValue("user1"))
+	assert.Equal(`a\,b\+c\=d\\e\;f\<g\>h\"`, escapeDNValue("a,b+c=d\\e;f<g>h\""))
+	assert.Equal("\\#a#", escapeDNValue("#a#"))
+	assert.Equal("\\ a b\\ ", escapeDNValue(" a b "))
+	assert.Equal("a\\00", escapeDNValue("a\x00"))
+}
+
+func TestBer(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	assert.Equal([]byte{BER_INTEGER, 1, 3}, berInteger(3))
+	assert.Equal([]byte{BER_INTEGER, 2, 0, 0x80}, berInteger(128))
+	assert.Equal([]byte{BER_INTEGER, 2, 1, 0}, berInteger(256))
+	assert.Equal(int64(256), parseBerInteger([]byte{1, 0}))
+	assert.Equal(int64(-1), parseBerInteger([]byte{0xff}))
+
+	long := make([]byte, 300)
+	element := berElement(BER_OCTET_STRING, long)
+	assert.Equal([]byte{BER_OCTET_STRING, 0x82, 1, 44}, element[:4])
+	tag, content, err := readBerElement(strings.NewReader(string(element)))
+	assert.Nil(err)
+	assert.Equal(byte(BER_OCTET_STRING), tag)
+	assert.Equal(300, len(content))
+
+	_, _, err = readBerElement(strings.NewReader(string(element[:100])))
+	assert.NotNil(err)
+	_, _, err = readBerElement(strings.NewReader("\x04\x84\xff\xff\xff\xff"))
+	assert.NotNil(err)
+}
@@ -0,0 +1,146 @@
+package gors
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"libs/bcrypt"
+)
+
+/* ------------------------------------ ownCloud Authenticator ----------------------------- */
+
+// ownCloudAuthenticator checks passwords against the users table of ownCloud, so users of
+// OWNCLOUD mode can log in with their ownCloud password. gors itself imports no SQL driver,
+// the main package registers them (see the build tags there).
+
+type OwnCloudConfig struct {
+	// DBDriver is the name of the SQL driver, like sqlite3 or mysql
+	DBDriver     string
+	// DSN is the data source name of the ownCloud database, like /var/www/owncloud/data/owncloud.db
+	// or owncloud:password@tcp(localhost:3306)/owncloud
+	DSN          string
+	TablePrefix  string
+	// PasswordSalt is the passwordsalt of config.php, which was used by ownCloud before version 8
+	PasswordSalt string
+}
+
+const DEFAULT_OWNCLOUD_TABLE_PREFIX = "oc_"
+
+type ownCloudAuthenticator struct {
+	db     *sql.DB
+	config OwnCloudConfig
+}
+
+func newOwnCloudAuthenticator(config OwnCloudConfig) (*ownCloudAuthenticator, error) {
+	if config.TablePrefix == "" {
+		config.TablePrefix = DEFAULT_OWNCLOUD_TABLE_PREFIX
+	}
+	db, err := sql.Open(config.DBDriver, config.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &ownCloudAuthenticator{db, config}, nil
+}
+
+func (a *ownCloudAuthenticator) Authenticate(username string, password string) (bool, error) {
+	hash, err := a.passwordHash(username)
+	if err != nil || hash == "" {
+		return false, err
+	}
+	return isOwnCloudHashValid(hash, password, a.config.PasswordSalt)
+}
+
+func (a *ownCloudAuthenticator) UserExists(username string) bool {
+	hash, err := a.passwordHash(username)
+	if err != nil {
+		fmt.Println("Error", err)
+	}
+	return hash != ""
+}
+
+// passwordHash returns the password hash of the user ("" for unknown users).
+func (a *ownCloudAuthenticator) passwordHash(username string) (string, error) {
+	var hash string
+	err := a.db.QueryRow("SELECT password FROM " + a.config.TablePrefix + "users WHERE uid = ?", username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+// isOwnCloudHashValid checks the password hash formats of the different ownCloud versions.
+func isOwnCloudHashValid(hash string, password string, salt string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "1|"):
+		// ownCloud 8+: version 1 of its Hasher, a bcrypt hash of the password
+		return isBcryptHashValid(hash[2:], password)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2y$"):
+		return isBcryptHashValid(hash, password + salt)
+	case strings.HasPrefix(hash, "$P$"), strings.HasPrefix(hash, "$H$"):
+		return constantTimeEquals(hash, phpassHash(password + salt, hash)), nil
+	case len(hash) == 40:
+		// very old ownCloud versions stored SHA-1 with or without the salt
+		return constantTimeEquals(hash, sha1Hex(password + salt)) || constantTimeEquals(hash, sha1Hex(password)), nil
+	}
+	return false, errors.New("Unsupported ownCloud password hash")
+}
+
+func isBcryptHashValid(hash string, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// phpassHash computes the portable hash of phpass with the settings (count and salt) of the stored hash.
+// It returns "" for invalid settings.
+func phpassHash(password string, setting string) string {
+	if len(setting) < 12 {
+		return ""
+	}
+	countLog2 := strings.IndexByte(APR1_ALPHABET, setting[3])
+	if countLog2 < 7 || countLog2 > 30 {
+		return ""
+	}
+	salt := setting[4:12]
+	hash := md5.Sum([]byte(salt + password))
+	for count := 1 << uint(countLog2); count > 0; count-- {
+		hash = md5.Sum(append(hash[:], password...))
+	}
+	return setting[:12] + phpassEncode(hash[:])
+}
+
+func phpassEncode(input []byte) string {
+	var encoded []byte
+	for i := 0; i < len(input); i += 3 {
+		value := uint(input[i])
+		chars := 2
+		if i + 1 < len(input) {
+			value |= uint(input[i + 1]) << 8
+			chars = 3
+		}
+		if i + 2 < len(input) {
+			value |= uint(input[i + 2]) << 16
+			chars = 4
+		}
+		for ; chars > 0; chars-- {
+			encoded = append(encoded, APR1_ALPHABET[value & 0x3f])
+			value >>= 6
+		}
+	}
+	return string(encoded)
+}
@@ -0,0 +1,68 @@
+//go:build sqlite
+// +build sqlite
+
+package gors
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"libs/assrt"
+	"libs/bcrypt"
+	_ "libs/sqlite3"
+)
+
+// Run with: go test -tags sqlite gors (the driver in libs/sqlite3 needs cgo)
+func TestOwnCloudAuthenticator(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+
+	dsn := dataPath + "/owncloud.db"
+	db, err := sql.Open("sqlite3", dsn)
+	assert.MustNil(err)
+	defer db.Close()
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	for _, statement := range []string{
+		"CREATE TABLE oc_users (uid VARCHAR(64) PRIMARY KEY, displayname VARCHAR(64), password VARCHAR(255))",
+		"INSERT INTO oc_users (uid, password) VALUES ('newuser', '1|" + string(bcryptHash) + "')",
+		"INSERT INTO oc_users (uid, password) VALUES ('olduser', '" + phpassHash("oldpasswordsalt", "$P$9IQRaTwmfeRo7ud9Fh4E2PdI0S3r.L0") + "')",
+		"INSERT INTO oc_users (uid, password) VALUES ('quote''user', '" + sha1Hex("password") + "')",
+	} {
+		_, err := db.Exec(statement)
+		assert.MustNil(err, statement)
+	}
+
+	ownCloud, err := newOwnCloudAuthenticator(OwnCloudConfig{DBDriver: "sqlite3", DSN: dsn, PasswordSalt: "salt"})
+	assert.MustNil(err)
+	authenticator = ownCloud
+	defer func() { authenticator = passwordFileAuthenticator{} }()
+
+	for _, test := range []struct {
+		username string
+		password string
+		valid    bool
+	}{
+		{"newuser", "password", true},
+		{"newuser", "wrong", false},
+		{"olduser", "oldpassword", true},
+		{"olduser", "password", false},
+		{"quote'user", "password", true},
+		{"unknown", "password", false},
+		{"user1", "password", false},
+		{"' OR '1'='1", "password", false},
+	} {
+		isValid, err := authenticator.Authenticate(test.username, test.password)
+		assert.Nil(err, test)
+		assert.Equal(test.valid, isValid, test)
+	}
+	assert.True(userExists("newuser"))
+	assert.True(!userExists("unknown"))
+
+	w := auth("POST", AUTH_PATH + "newuser" + AUTH_QUERY, "password")
+	assert.Equal(303, w.Code)
+	assert.True(strings.HasPrefix(w.Header().Get("Location"), "https://app.example.com/#access_token="))
+
+	_, err = newOwnCloudAuthenticator(OwnCloudConfig{DBDriver: "unknown", DSN: dsn})
+	assert.NotNil(err)
+}
@@ -0,0 +1,42 @@
+package gors
+
+import (
+	"testing"
+	"libs/assrt"
+	"libs/bcrypt"
+)
+
+func TestPhpassHash(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	// test vector of phpass
+	assert.Equal("$P$9IQRaTwmfeRo7ud9Fh4E2PdI0S3r.L0", phpassHash("test12345", "$P$9IQRaTwmfeRo7ud9Fh4E2PdI0S3r.L0"))
+	assert.Equal("", phpassHash("test12345", "$P$9IQRa"))
+	assert.Equal("", phpassHash("test12345", "$P$.IQRaTwmfeRo7ud9Fh4E2PdI0S3r.L0"))
+}
+
+func TestOwnCloudHashes(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	saltedBcryptHash, _ := bcrypt.GenerateFromPassword([]byte("passwordsalt"), bcrypt.MinCost)
+	for _, hash := range []string{
+		"1|" + string(bcryptHash),
+		"1|$2y$" + string(bcryptHash[4:]),
+		string(saltedBcryptHash),
+		phpassHash("passwordsalt", "$P$9IQRaTwmfeRo7ud9Fh4E2PdI0S3r.L0"),
+		phpassHash("passwordsalt", "$H$9IQRaTwmfeRo7ud9Fh4E2PdI0S3r.L0"),
+		sha1Hex("passwordsalt"),
+		sha1Hex("password"),
+	} {
+		isValid, err := isOwnCloudHashValid(hash, "password", "salt")
+		assert.Nil(err, hash)
+		assert.True(isValid, hash)
+		isValid, err = isOwnCloudHashValid(hash, "wrong", "salt")
+		assert.Nil(err, hash)
+		assert.True(!isValid, hash)
+	}
+
+	_, err := isOwnCloudHashValid("2|$argon2i$v=19$m=65536,t=4,p=1$c2FsdA$aGFzaA", "password", "salt")
+	assert.NotNil(err)
+	_, err = isOwnCloudHashValid("password", "password", "salt")
+	assert.NotNil(err)
+}
@@ -0,0 +1,180 @@
+package gors
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ------------------------------------ Passwords ----------------------------- */
+
+// Users of the file authenticator can change their password on the dashboard or, if they forgot it,
+// with a reset link, which an admin creates with the CLI. Both can sign out all apps by revoking their tokens.
+// Signing out on the dashboard also ends the sessions in other browsers and forgets the consents. A reset
+// always does that for all sessions, because somebody else might know the old password.
+
+const DEFAULT_MIN_PASSWORD_LENGTH = 10
+
+var minPasswordLength = DEFAULT_MIN_PASSWORD_LENGTH
+
+func checkPasswordPolicy(username string, password string, password2 string) error {
+	if password != password2 {
+		return errors.New("The passwords do not match.")
+	}
+	if len([]rune(password)) < minPasswordLength {
+		return errors.New("The password needs at least " + strconv.Itoa(minPasswordLength) + " characters.")
+	}
+	if strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errors.New("The password must not contain the username.")
+	}
+	return nil
+}
+
+// canChangePassword tells, if the passwords are stored by gors and not by LDAP etc.
+func canChangePassword() bool {
+	_, isFileAuthenticator := authenticator.(passwordFileAuthenticator)
+	return isFileAuthenticator
+}
+
+func writePasswordFile(username string, password string) error {
+	passwordFilename := userGorsDir(username) + PASSWORD_FILE_NAME
+	if err := ioutil.WriteFile(passwordFilename, []byte(sha512Sum(password) + "\n"), 0600); err != nil {
+		return err
+	}
+	chownIfNeeded(passwordFilename, username)
+	return nil
+}
+
+// changePassword sets the new password and with revokeTokens revokes the tokens of all apps of the user.
+func changePassword(username string, password string, password2 string, revokeTokens bool) error {
+	if !canChangePassword() {
+		return errors.New("The password can't be changed here.")
+	}
+	if err := checkPasswordPolicy(username, password, password2); err != nil {
+		return err
+	}
+	if err := writePasswordFile(username, password); err != nil {
+		fmt.Println("Error", err)
+		return errors.New("The password couldn't be saved.")
+	}
+	if revokeTokens {
+		if err := revokeAuthorizations(username); err != nil {
+			fmt.Println("Error", err)
+			return errors.New("The password has been changed, but the apps couldn't be signed out.")
+		}
+	}
+	return nil
+}
+
+// signOutBrowsers ends all sessions of the user except keepSessionId ("" for all) and forgets the consents,
+// so nobody gets new tokens without the new password.
+func signOutBrowsers(username string, keepSessionId string) {
+	endUserSessions(username, keepSessionId)
+	if err := removeConsents(username); err != nil {
+		fmt.Println("Error", err)
+	}
+}
+
+/* ---- Reset Links ---- */
+
+var PASSWORD_RESET_PATH = GORS_PATH + "/password-reset/"
+
+const PASSWORD_RESET_FILE_NAME = "password-reset.json"
+
+const PASSWORD_RESET_LIFETIME = 24 * time.Hour
+
+// Only the hash of the reset token is stored, so the CLI and the server don't need to share anything else.
+type passwordReset struct {
+	TokenHash string    `json:"tokenHash"`
+	Expires   time.Time `json:"expires"`
+}
+
+// CreatePasswordResetLink returns a link, which lets the user set a new password once within PASSWORD_RESET_LIFETIME.
+// Only the newest link of a user is valid.
+func CreatePasswordResetLink(config Config, username string) (string, error) {
+	configure(config)
+	if !canChangePassword() {
+		return "", errors.New("Passwords can be reset only with the file authenticator")
+	}
+	if !userExists(username) {
+		return "", errors.New("Unknown user: " + username)
+	}
+	token := hex.EncodeToString(randomBytes(32))
+	reset := passwordReset{sha512Sum(token), time.Now().Add(PASSWORD_RESET_LIFETIME)}
+	resetJson, err := json.Marshal(reset)
+	if err != nil {
+		return "", err
+	}
+	resetFilename := userGorsDir(username) + PASSWORD_RESET_FILE_NAME
+	if err := ioutil.WriteFile(resetFilename, resetJson, 0600); err != nil {
+		return "", err
+	}
+	chownIfNeeded(resetFilename, username)
+
+	baseUrl := externalBaseUrl
+	if baseUrl == "" {
+		baseUrl = "http://localhost:" + strconv.Itoa(config.Port)
+	}
+	return baseUrl + PASSWORD_RESET_PATH + username + "?token=" + token, nil
+}
+
+func isPasswordResetTokenValid(username string, token string) bool {
+	resetJson, err := ioutil.ReadFile(userGorsDir(username) + PASSWORD_RESET_FILE_NAME)
+	if err != nil {
+		return false
+	}
+	var reset passwordReset
+	if err := json.Unmarshal(resetJson, &reset); err != nil {
+		fmt.Println("Error", err)
+		return false
+	}
+	return token != "" && time.Now().Before(reset.Expires) &&
+		subtle.ConstantTimeCompare([]byte(reset.TokenHash), []byte(sha512Sum(token))) == 1
+}
+
+func handlePasswordReset(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Path[len(PASSWORD_RESET_PATH):]
+	token := r.URL.Query().Get("token")
+	setFrameBustingHeaders(w)
+	w.Header().Set("Cache-Control", "no-store")
+	// the token in the URL must not leak to other sites
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	if !userExists(username) || !canChangePassword() || !isPasswordResetTokenValid(username, token) {
+		renderAuthError(w, 404, "This link is not valid (anymore).")
+		return
+	}
+	data := map[string]interface{} {
+		"username": username,
+		"minPasswordLength": minPasswordLength,
+	}
+
+	if r.Method == "POST" {
+		if !isCsrfTokenValid(r) {
+			renderAuthError(w, 403, "The form has expired. Please reload the page and try again.")
+			return
+		}
+		err := changePassword(username, r.PostFormValue("password"), r.PostFormValue("password2"), r.PostFormValue("revoke") != "")
+		if err == nil {
+			signOutBrowsers(username, "")
+			if err := os.Remove(userGorsDir(username) + PASSWORD_RESET_FILE_NAME); err != nil {
+				fmt.Println("Error", err)
+			}
+			data["changed"] = true
+			renderTemplate(w, "password-reset.html", data)
+			return
+		}
+		data["error"] = err.Error()
+	}
+
+	data["csrfToken"] = csrfToken(w, r)
+	renderTemplate(w, "password-reset.html", data)
+}
@@ -0,0 +1,103 @@
+package gors
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"libs/assrt"
+)
+
+func TestChangePassword(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+	authorization := newAuthorization("user1", "example.com", []Scope{Scope{"module", true}})
+	defer removeAuthorization(authorization.bearerToken)
+
+	page, cookies := postDashboard(assert, url.Values{"password": {"password"}}, nil)
+	assert.True(strings.Contains(page, `value="change-password"`))
+
+	changeForm := func(password string, newPassword string, newPassword2 string) url.Values {
+		return url.Values{"action": {"change-password"}, "password": {password}, "newPassword": {newPassword}, "newPassword2": {newPassword2}}
+	}
+	page, _ = postDashboard(assert, changeForm("wrong", "a new password", "a new password"), cookies)
+	assert.True(strings.Contains(page, "Wrong Password"))
+	page, _ = postDashboard(assert, changeForm("password", "short", "short"), cookies)
+	assert.True(strings.Contains(page, "at least 10 characters"))
+	assert.True(isPasswordValid("user1", "password"))
+
+	page, _ = postDashboard(assert, changeForm("password", "a new password", "a new password"), cookies)
+	assert.True(strings.Contains(page, "Your password has been changed"))
+	assert.True(isPasswordValid("user1", "a new password"))
+	assert.True(!isPasswordValid("user1", "password"))
+	assert.NotNil(lookupAuthorization(authorization.bearerToken))
+
+	// signing out the apps ends the other sessions too
+	_, otherCookies := postDashboard(assert, url.Values{"password": {"a new password"}}, nil)
+	assert.MustNil(addConsent("user1", "https://app.example.com", []Scope{Scope{"module", true}}))
+	form := changeForm("a new password", "another password", "another password")
+	form.Set("revoke", "yes")
+	page, _ = postDashboard(assert, form, cookies)
+	assert.True(strings.Contains(page, "Your password has been changed"))
+	assert.True(isPasswordValid("user1", "another password"))
+	assert.Nil(lookupAuthorization(authorization.bearerToken))
+	consents, _ := readConsents("user1")
+	assert.Equal(0, len(consents))
+	w := getWithCookies(handleDashboard, DASHBOARD_PATH + "user1", cookies)
+	assert.True(strings.Contains(w.Body.String(), `value="change-password"`))
+	w = getWithCookies(handleDashboard, DASHBOARD_PATH + "user1", otherCookies)
+	assert.True(!strings.Contains(w.Body.String(), `value="change-password"`))
+}
+
+func TestPasswordResetLink(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+	authorization := newAuthorization("user1", "example.com", []Scope{Scope{"module", true}})
+	defer removeAuthorization(authorization.bearerToken)
+
+	config := Config{StorageDir: dataPath, StorageMode: HOME, ResourcesPath: "..", Port: 8888}
+	_, err := CreatePasswordResetLink(config, "unknown")
+	assert.NotNil(err)
+	link, err := CreatePasswordResetLink(config, "user1")
+	assert.MustNil(err)
+	assert.True(strings.HasPrefix(link, "http://localhost:8888" + PASSWORD_RESET_PATH + "user1?token="), link)
+	resetUrl := link[len("http://localhost:8888"):]
+
+	for _, invalidUrl := range []string{resetUrl + "x", PASSWORD_RESET_PATH + "user1", PASSWORD_RESET_PATH + "user1?token=", PASSWORD_RESET_PATH + "unknown"} {
+		w := getWithCookies(handlePasswordReset, invalidUrl, nil)
+		assert.Equal(404, w.Code, invalidUrl)
+	}
+
+	w := getWithCookies(handlePasswordReset, resetUrl, nil)
+	assert.Equal(200, w.Code)
+	assert.Equal("no-referrer", w.Header().Get("Referrer-Policy"))
+	match := CSRF_TOKEN_INPUT_PATTERN.FindStringSubmatch(w.Body.String())
+	assert.MustNotNil(match)
+	cookies := w.Result().Cookies()
+	_, sessionCookies := postDashboard(assert, url.Values{"password": {"password"}}, nil)
+	assert.MustNil(addConsent("user1", "https://app.example.com", []Scope{Scope{"module", true}}))
+
+	form := url.Values{CSRF_TOKEN_FIELD: {match[1]}, "password": {"a new password"}, "password2": {"other password"}}
+	w = postForm(handlePasswordReset, resetUrl, form, cookies)
+	assert.True(strings.Contains(w.Body.String(), "do not match"))
+
+	form = url.Values{CSRF_TOKEN_FIELD: {match[1]}, "password": {"a new password"}, "password2": {"a new password"}, "revoke": {"yes"}}
+	w = postForm(handlePasswordReset, resetUrl, form, []*http.Cookie{})
+	assert.Equal(403, w.Code)
+	w = postForm(handlePasswordReset, resetUrl, form, cookies)
+	assert.Equal(200, w.Code)
+	assert.True(strings.Contains(w.Body.String(), "Your password has been changed"))
+	assert.True(isPasswordValid("user1", "a new password"))
+	assert.Nil(lookupAuthorization(authorization.bearerToken))
+	// whoever knew the old password is logged out
+	w = getWithCookies(handleDashboard, DASHBOARD_PATH + "user1", sessionCookies)
+	assert.True(!strings.Contains(w.Body.String(), `value="change-password"`))
+	consents, _ := readConsents("user1")
+	assert.Equal(0, len(consents))
+
+	// the link works only once
+	w = getWithCookies(handlePasswordReset, resetUrl, nil)
+	assert.Equal(404, w.Code)
+}
@@ -0,0 +1,175 @@
+package gors
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/* ------------------------------------ Registration ----------------------------- */
+
+// With registration enabled new users can sign up at REGISTER_PATH, either freely (OPEN_REGISTRATION)
+// or with an invitation code (INVITE_REGISTRATION), which can be used only once. The invitation file
+// contains one code per line. Registered users get a password file, so it needs the file authenticator.
+
+var REGISTER_PATH = GORS_PATH + "/register"
+
+const (
+	OPEN_REGISTRATION   = "open"
+	INVITE_REGISTRATION = "invite"
+)
+
+type RegistrationConfig struct {
+	// Mode is OPEN_REGISTRATION, INVITE_REGISTRATION or "" (no registration)
+	Mode            string
+	InvitationFile  string
+	UsernamePattern string
+}
+
+const DEFAULT_USERNAME_PATTERN = `^[a-z][a-z0-9_-]{2,31}$`
+
+var registration RegistrationConfig
+var usernamePattern *regexp.Regexp
+var registrationMutex sync.Mutex
+
+func configureRegistration(config RegistrationConfig) error {
+	registration = config
+	if config.Mode == "" {
+		return nil
+	}
+	if config.Mode != OPEN_REGISTRATION && config.Mode != INVITE_REGISTRATION {
+		return errors.New("Unknown registration mode: " + config.Mode)
+	}
+	if config.Mode == INVITE_REGISTRATION && config.InvitationFile == "" {
+		return errors.New("Registration with invitations needs an invitation file")
+	}
+	if !canChangePassword() {
+		return errors.New("Registration needs the file authenticator")
+	}
+	if registration.UsernamePattern == "" {
+		registration.UsernamePattern = DEFAULT_USERNAME_PATTERN
+	}
+	var err error
+	usernamePattern, err = regexp.Compile(registration.UsernamePattern)
+	return err
+}
+
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	setFrameBustingHeaders(w)
+	w.Header().Set("Cache-Control", "no-store")
+	if registration.Mode == "" {
+		http.NotFound(w, r)
+		return
+	}
+	data := map[string]interface{} {
+		"inviteOnly": registration.Mode == INVITE_REGISTRATION,
+		"minPasswordLength": minPasswordLength,
+	}
+
+	if r.Method == "POST" {
+		if !isCsrfTokenValid(r) {
+			renderAuthError(w, 403, "The form has expired. Please reload the page and try again.")
+			return
+		}
+		username := strings.TrimSpace(r.PostFormValue("username"))
+		err := registerUser(username, r.PostFormValue("password"), r.PostFormValue("password2"), strings.TrimSpace(r.PostFormValue("invitation")))
+		if err == nil {
+			startSession(w, r, username)
+			http.Redirect(w, r, DASHBOARD_PATH + username, 303)
+			return
+		}
+		data["error"] = err.Error()
+		data["username"] = username
+	}
+
+	data["csrfToken"] = csrfToken(w, r)
+	renderTemplate(w, "register.html", data)
+}
+
+func registerUser(username string, password string, password2 string, invitation string) error {
+	if !usernamePattern.MatchString(username) || !isValidUsername(username) {
+		return errors.New("This username is not allowed.")
+	}
+	if err := checkPasswordPolicy(username, password, password2); err != nil {
+		return err
+	}
+
+	registrationMutex.Lock()
+	defer registrationMutex.Unlock()
+	// the folder of the user might belong to somebody else, even without .gors folder (e.g. a home folder)
+	if existUser, _ := exists(dataPath + "/" + username); existUser {
+		return errors.New("This username is already taken.")
+	}
+	if registration.Mode == INVITE_REGISTRATION {
+		if _, _, err := findInvitation(invitation); err != nil {
+			return err
+		}
+	}
+	if err := createUser(username, password); err != nil {
+		return err
+	}
+	// the invitation is used up only when the user exists, so it isn't lost if the user can't be created
+	if registration.Mode == INVITE_REGISTRATION {
+		if err := useInvitation(invitation); err != nil {
+			fmt.Println("Error", err)
+			os.RemoveAll(dataPath + "/" + username)
+			return errors.New("Invitations can't be checked at the moment.")
+		}
+	}
+	return nil
+}
+
+// findInvitation returns the lines of the invitation file and the index of the invitation code.
+func findInvitation(invitation string) ([]string, int, error) {
+	content, err := ioutil.ReadFile(registration.InvitationFile)
+	if err != nil {
+		fmt.Println("Error", err)
+		return nil, 0, errors.New("Invitations can't be checked at the moment.")
+	}
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		if invitation != "" && strings.TrimSpace(line) == invitation {
+			return lines, i, nil
+		}
+	}
+	return nil, 0, errors.New("This invitation code is not valid.")
+}
+
+// useInvitation removes the invitation code from the invitation file.
+func useInvitation(invitation string) error {
+	lines, i, err := findInvitation(invitation)
+	if err != nil {
+		return err
+	}
+	lines = append(lines[:i], lines[i+1:]...)
+	return ioutil.WriteFile(registration.InvitationFile, []byte(strings.Join(lines, "\n")), 0600)
+}
+
+// createUser creates the folders of the user for the storage mode and the password file.
+// If that fails, nothing of the user is left behind.
+func createUser(username string, password string) error {
+	userDir := filepath.Clean(dataPath + "/" + username)
+	if err := os.Mkdir(userDir, os.ModePerm); err != nil {
+		return err
+	}
+	chownIfNeeded(userDir, username)
+	dataDir := filepath.Clean(getUserDataPath(username))
+	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
+		os.RemoveAll(userDir)
+		return err
+	}
+	for dir := dataDir; dir != userDir; dir = filepath.Dir(dir) {
+		chownIfNeeded(dir, username)
+	}
+	if err := writePasswordFile(username, password); err != nil {
+		os.RemoveAll(userDir)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package gors
+
+import (
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"libs/assrt"
+)
+
+func withRegistration(t *testing.T, config RegistrationConfig) func() {
+	done := withAuthUser1(t)
+	if err := configureRegistration(config); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		done()
+		configureRegistration(RegistrationConfig{})
+	}
+}
+
+// register posts the registration form like a browser, which got the form before.
+func register(assert *assrt.Assert, form url.Values) (int, string) {
+	w := getWithCookies(handleRegister, REGISTER_PATH, nil)
+	match := CSRF_TOKEN_INPUT_PATTERN.FindStringSubmatch(w.Body.String())
+	assert.MustNotNil(match)
+	form.Set(CSRF_TOKEN_FIELD, match[1])
+	w = postForm(handleRegister, REGISTER_PATH, form, w.Result().Cookies())
+	return w.Code, w.Body.String()
+}
+
+func registrationForm(username string, password string) url.Values {
+	return url.Values{"username": {username}, "password": {password}, "password2": {password}}
+}
+
+func TestRegistrationDisabled(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+
+	w := getWithCookies(handleRegister, REGISTER_PATH, nil)
+	assert.Equal(404, w.Code)
+}
+
+func TestOpenRegistration(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withRegistration(t, RegistrationConfig{Mode: OPEN_REGISTRATION})
+	defer done()
+
+	w := getWithCookies(handleRegister, REGISTER_PATH, nil)
+	assert.Equal(200, w.Code)
+	assert.Equal("DENY", w.Header().Get("X-Frame-Options"))
+	assert.True(!strings.Contains(w.Body.String(), `name="invitation"`))
+
+	code, _ := register(assert, registrationForm("newuser", "a long password"))
+	assert.Equal(303, code)
+	assert.True(userExists("newuser"))
+	existData, _ := exists(getUserDataPath("newuser"))
+	assert.True(existData)
+	valid, err := authenticator.Authenticate("newuser", "a long password")
+	assert.Nil(err)
+	assert.True(valid)
+
+	code, page := register(assert, registrationForm("newuser", "another password"))
+	assert.Equal(200, code)
+	assert.True(strings.Contains(page, "already taken"))
+	valid, _ = authenticator.Authenticate("newuser", "a long password")
+	assert.True(valid)
+}
+
+func TestRegistrationRules(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withRegistration(t, RegistrationConfig{Mode: OPEN_REGISTRATION})
+	defer done()
+
+	tests := []struct {
+		form    url.Values
+		message string
+	}{
+		{registrationForm("user1", "a long password"), "already taken"},
+		{registrationForm("ab", "a long password"), "not allowed"},
+		{registrationForm("New", "a long password"), "not allowed"},
+		{registrationForm("../etc", "a long password"), "not allowed"},
+		{registrationForm("newuser", "short"), "at least 10 characters"},
+		{registrationForm("newuser", "newuser1234"), "must not contain the username"},
+		{url.Values{"username": {"newuser"}, "password": {"a long password"}, "password2": {"a long passwort"}}, "do not match"},
+	}
+	for _, test := range tests {
+		code, page := register(assert, test.form)
+		assert.Equal(200, code, test.form)
+		assert.True(strings.Contains(page, test.message), test.form)
+	}
+	assert.True(!userExists("newuser"))
+
+	w := postForm(handleRegister, REGISTER_PATH, registrationForm("newuser", "a long password"), nil)
+	assert.Equal(403, w.Code)
+	assert.True(!userExists("newuser"))
+}
+
+func TestInviteRegistration(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+	invitationFile := dataPath + "/invitations.txt"
+	ioutil.WriteFile(invitationFile, []byte("code1\ncode2\n"), 0600)
+	assert.MustNil(configureRegistration(RegistrationConfig{Mode: INVITE_REGISTRATION, InvitationFile: invitationFile}))
+	defer configureRegistration(RegistrationConfig{})
+
+	w := getWithCookies(handleRegister, REGISTER_PATH, nil)
+	assert.True(strings.Contains(w.Body.String(), `name="invitation"`))
+
+	for _, invitation := range []string{"", "wrong"} {
+		form := registrationForm("newuser", "a long password")
+		form.Set("invitation", invitation)
+		code, page := register(assert, form)
+		assert.Equal(200, code)
+		assert.True(strings.Contains(page, "invitation code is not valid"))
+	}
+
+	form := registrationForm("newuser", "a long password")
+	form.Set("invitation", "code1")
+	code, _ := register(assert, form)
+	assert.Equal(303, code)
+	assert.True(userExists("newuser"))
+
+	form = registrationForm("otheruser", "a long password")
+	form.Set("invitation", "code1")
+	code, _ = register(assert, form)
+	assert.Equal(200, code)
+	assert.True(!userExists("otheruser"))
+
+	invitations, _ := ioutil.ReadFile(invitationFile)
+	assert.Equal("code2\n", string(invitations))
+
+	// the invitation isn't used up, if the user can't be created
+	storageDir := dataPath
+	dataPath = storageDir + "/missing"
+	form = registrationForm("otheruser", "a long password")
+	form.Set("invitation", "code2")
+	code, _ = register(assert, form)
+	dataPath = storageDir
+	assert.Equal(200, code)
+	invitations, _ = ioutil.ReadFile(invitationFile)
+	assert.Equal("code2\n", string(invitations))
+}
+
+func TestRegistrationConfig(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	defer configureRegistration(RegistrationConfig{})
+
+	assert.NotNil(configureRegistration(RegistrationConfig{Mode: "everybody"}))
+	assert.NotNil(configureRegistration(RegistrationConfig{Mode: INVITE_REGISTRATION}))
+	assert.NotNil(configureRegistration(RegistrationConfig{Mode: OPEN_REGISTRATION, UsernamePattern: "("}))
+
+	oldAuthenticator := authenticator
+	defer func() { authenticator = oldAuthenticator }()
+	authenticator = ldapAuthenticator{}
+	assert.NotNil(configureRegistration(RegistrationConfig{Mode: OPEN_REGISTRATION}))
+}
+
@@ -0,0 +1,409 @@
+package gors
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* ------------------------------------ S3 Storage ----------------------------- */
+
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string
+}
+
+// s3Storage keeps the documents of every user as objects in an S3 compatible bucket.
+// The object key of a document is [Prefix]username/path and its content type is the
+// Content-Type of the object. Every folder has an empty marker object whose
+// modification time is the version of the folder, just like the mtime of a directory.
+type s3Storage struct {
+	config S3Config
+	client *http.Client
+}
+
+const S3_FOLDER_MARKER = ".rsfolder"
+
+func newS3Storage(config S3Config) *s3Storage {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &s3Storage{config, &http.Client{}}
+}
+
+func (s *s3Storage) key(username string, path string) string {
+	return s.config.Prefix + username + path
+}
+
+func (s *s3Storage) folderMarkerKey(username string, folderPath string) string {
+	return s.key(username, folderPath) + S3_FOLDER_MARKER
+}
+
+func (s *s3Storage) Stat(username string, path string) (*Item, error) {
+	if isDirListingRequest(path) {
+		return s.statFolder(username, path)
+	}
+	resp, err := s.request("HEAD", s.key(username, path), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return itemFromS3Response(path, resp), nil
+}
+
+func (s *s3Storage) statFolder(username string, path string) (*Item, error) {
+	resp, err := s.request("HEAD", s.folderMarkerKey(username, path), nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		item := itemFromS3Response(path, resp)
+		item.Name = folderName(path)
+		item.IsDir = true
+		return item, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// a folder created by another tool has no marker, so we use its newest item as version
+	items, err := s.List(username, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, os.ErrNotExist
+	}
+	item := Item{Name: folderName(path), IsDir: true}
+	for _, child := range items {
+		if child.ModTime.After(item.ModTime) {
+			item.ModTime = child.ModTime
+		}
+	}
+	return &item, nil
+}
+
+func (s *s3Storage) List(username string, path string) ([]Item, error) {
+	prefix := s.key(username, path)
+	items := []Item{}
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		resp, err := s.request("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			name := object.Key[len(prefix):]
+			if name == "" || name == S3_FOLDER_MARKER {
+				continue
+			}
+			modTime, _ := time.Parse(time.RFC3339, object.LastModified)
+			items = append(items, Item{Name: name, ModTime: modTime, Size: object.Size})
+		}
+		for _, commonPrefix := range result.CommonPrefixes {
+			folder, err := s.Stat(username, path + commonPrefix.Prefix[len(prefix):])
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, *folder)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+	sort.Sort(itemsByName(items))
+	return items, nil
+}
+
+func (s *s3Storage) Open(username string, path string) (Document, *Item, error) {
+	resp, err := s.request("GET", s.key(username, path), nil, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nopCloser{bytes.NewReader(body)}, itemFromS3Response(path, resp), nil
+}
+
+func (s *s3Storage) Put(username string, path string, body io.Reader, meta *Item) (*Item, error) {
+	if isDirListingRequest(path) {
+		return nil, errors.New("Can't put a folder: " + path)
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if meta.ContentType != "" {
+		header.Set("Content-Type", meta.ContentType)
+	}
+	for name, value := range meta.Meta {
+		header.Set(S3_META_HEADER_PREFIX + name, value)
+	}
+	resp, err := s.request("PUT", s.key(username, path), nil, header, content)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	for _, folder := range ancestorFolders(path) {
+		if err := s.touchFolder(username, folder); err != nil {
+			return nil, err
+		}
+	}
+	return s.Stat(username, path)
+}
+
+func (s *s3Storage) Delete(username string, path string) error {
+	resp, err := s.request("DELETE", s.key(username, path), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	folders := ancestorFolders(path)
+	for i := len(folders) - 1; i >= 0; i-- {
+		folder := folders[i]
+		items, err := s.List(username, folder)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 && folder != "/" {
+			err = s.removeFolder(username, folder)
+		} else {
+			err = s.touchFolder(username, folder)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Storage) touchFolder(username string, folderPath string) error {
+	resp, err := s.request("PUT", s.folderMarkerKey(username, folderPath), nil, nil, []byte{})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) removeFolder(username string, folderPath string) error {
+	resp, err := s.request("DELETE", s.folderMarkerKey(username, folderPath), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ancestorFolders returns the folders containing path, starting with the root folder "/".
+func ancestorFolders(path string) []string {
+	folders := []string{"/"}
+	for i := 1; i < len(path); i++ {
+		if path[i] == '/' && i < len(path) - 1 {
+			folders = append(folders, path[:i + 1])
+		}
+	}
+	return folders
+}
+
+func folderName(folderPath string) string {
+	trimmed := strings.TrimSuffix(folderPath, "/")
+	return trimmed[strings.LastIndex(trimmed, "/") + 1:]
+}
+
+const S3_META_HEADER_PREFIX = "X-Amz-Meta-"
+
+func itemFromS3Response(path string, resp *http.Response) *Item {
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	item := &Item{
+		Name: path[strings.LastIndex(path, "/") + 1:],
+		ModTime: modTime,
+		Size: resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(name, S3_META_HEADER_PREFIX) && len(values) > 0 {
+			if item.Meta == nil {
+				item.Meta = make(map[string]string)
+			}
+			item.Meta[strings.ToLower(name[len(S3_META_HEADER_PREFIX):])] = values[0]
+		}
+	}
+	return item
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		LastModified string
+		Size         int64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+type itemsByName []Item
+
+func (items itemsByName) Len() int           { return len(items) }
+func (items itemsByName) Swap(i, j int)      { items[i], items[j] = items[j], items[i] }
+func (items itemsByName) Less(i, j int) bool { return items[i].Name < items[j].Name }
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+/* ------------------------------------ S3 Requests ----------------------------- */
+
+// request sends a request signed with AWS Signature Version 4 for the object key
+// (or the bucket itself if key is empty) and maps 404 responses to os.ErrNotExist.
+func (s *s3Storage) request(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	path := "/" + s.config.Bucket + "/" + key
+	rawQuery := canonicalS3Query(query)
+	urlString := s.config.Endpoint + s3Escape(path)
+	if rawQuery != "" {
+		urlString += "?" + rawQuery
+	}
+	req, err := http.NewRequest(method, urlString, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+	signS3Request(req, s.config, path, rawQuery, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 404 {
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("S3 %s %s failed with %d: %s", method, key, resp.StatusCode, message))
+	}
+	return resp, nil
+}
+
+func signS3Request(req *http.Request, config S3Config, path string, rawQuery string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// all x-amz-* headers (including user metadata) have to be signed
+	headerNames := []string{"host"}
+	for name := range req.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			headerNames = append(headerNames, strings.ToLower(name))
+		}
+	}
+	sort.Strings(headerNames)
+	canonicalHeaders := ""
+	for _, name := range headerNames {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonicalHeaders += name + ":" + value + "\n"
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(path),
+		rawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	signingKey := hmacSha256([]byte("AWS4" + config.SecretKey), date)
+	signingKey = hmacSha256(signingKey, config.Region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=" + config.AccessKey + "/" + scope +
+		", SignedHeaders=" + signedHeaders + ", Signature=" + signature)
+}
+
+func canonicalS3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key) + "=" + strings.Replace(s3Escape(value), "/", "%2F", -1))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything except unreserved characters and "/" as required by AWS.
+func s3Escape(s string) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
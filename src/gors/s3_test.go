@@ -0,0 +1,232 @@
+package gors
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"libs/assrt"
+)
+
+// fakeS3 is an in-process stand-in for an S3 compatible server with path style bucket access.
+// Its clock advances one second per write, so versions of consecutive changes always differ.
+type fakeS3 struct {
+	sync.Mutex
+	bucket  string
+	objects map[string]fakeS3Object
+	now     time.Time
+}
+
+type fakeS3Object struct {
+	body        []byte
+	contentType string
+	modTime     time.Time
+	meta        http.Header
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: map[string]fakeS3Object{}, now: time.Unix(1380000000, 0).UTC()}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		w.WriteHeader(403)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/" + s.bucket + "/") {
+		w.WriteHeader(404)
+		return
+	}
+	key := r.URL.Path[len(s.bucket) + 2:]
+	if key == "" && r.Method == "GET" {
+		s.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+		return
+	}
+	object, found := s.objects[key]
+	switch r.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		s.now = s.now.Add(time.Second)
+		meta := http.Header{}
+		for name, values := range r.Header {
+			if strings.HasPrefix(name, S3_META_HEADER_PREFIX) {
+				meta[name] = values
+			}
+		}
+		s.objects[key] = fakeS3Object{body, r.Header.Get("Content-Type"), s.now, meta}
+	case "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(204)
+	case "GET", "HEAD":
+		if !found {
+			w.WriteHeader(404)
+			return
+		}
+		for name, values := range object.meta {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("Last-Modified", object.modTime.Format(http.TimeFormat))
+		w.Write(object.body)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, prefix string, delimiter string) {
+	result := s3ListResult{}
+	seenPrefixes := map[string]bool{}
+	keys := []string{}
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := key[len(prefix):]
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			commonPrefix := prefix + rest[:i + 1]
+			if !seenPrefixes[commonPrefix] {
+				seenPrefixes[commonPrefix] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{commonPrefix})
+			}
+			continue
+		}
+		object := s.objects[key]
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			LastModified string
+			Size         int64
+		}{key, object.modTime.Format(time.RFC3339), int64(len(object.body))})
+	}
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3ListResult
+	}{s3ListResult: result})
+}
+
+func withS3Storage(t *testing.T) (*fakeS3, func()) {
+	fake := newFakeS3("gors")
+	server := httptest.NewServer(fake)
+	storage = newS3Storage(S3Config{Endpoint: server.URL, Bucket: "gors", AccessKey: "access", SecretKey: "secret"})
+	addAuthorization(Authorization{"user1", "example.com", []Scope{Scope{"root", true}}, "s3-token"})
+	return fake, func() {
+		server.Close()
+		storage = fsStorage{}
+		removeAuthorization("s3-token")
+	}
+}
+
+func storageRequest(method string, path string, body string, header map[string]string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, STORAGE_PATH + "user1" + path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer s3-token")
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handleStorage(w, r)
+	return w
+}
+
+func TestS3StoragePutAndGet(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	fake, done := withS3Storage(t)
+	defer done()
+
+	w := storageRequest("PUT", "/module/dir/file.json", `{"key":"value"}`, map[string]string{"Content-Type": "application/json"})
+	assert.Equal(200, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.Equal("application/json", fake.objects["user1/module/dir/file.json"].contentType)
+
+	w = storageRequest("GET", "/module/dir/file.json", "", nil)
+	assert.Equal(200, w.Code)
+	assert.Equal(`{"key":"value"}`, w.Body.String())
+	assert.Equal("application/json", w.Header().Get("Content-Type"))
+	assert.Equal(etag, w.Header().Get("ETag"))
+
+	w = storageRequest("GET", "/module/dir/file.json", "", map[string]string{"If-None-Match": etag})
+	assert.Equal(304, w.Code)
+	w = storageRequest("PUT", "/module/dir/file.json", "new", map[string]string{"If-Match": "invalid"})
+	assert.Equal(412, w.Code)
+	w = storageRequest("PUT", "/module/dir/file.json", "new", map[string]string{"If-None-Match": "*"})
+	assert.Equal(412, w.Code)
+	w = storageRequest("GET", "/module/missing.json", "", nil)
+	assert.Equal(404, w.Code)
+}
+
+func TestS3StorageDirectoryListing(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	_, done := withS3Storage(t)
+	defer done()
+
+	storageRequest("PUT", "/module/file.txt", "text", nil)
+	storageRequest("PUT", "/module/dir/new-file.txt", "new text", nil)
+
+	w := storageRequest("GET", "/module/", "", nil)
+	assert.Equal(200, w.Code)
+	assert.Equal("application/json", w.Header().Get("Content-Type"))
+	moduleETag := w.Header().Get("ETag")
+	var listing map[string]string
+	assert.MustNil(json.Unmarshal(w.Body.Bytes(), &listing))
+	assert.Equal(2, len(listing))
+	assert.NotEqual("", listing["file.txt"])
+	assert.NotEqual("", listing["dir/"])
+
+	w = storageRequest("GET", "/module/", "", map[string]string{"If-None-Match": moduleETag})
+	assert.Equal(304, w.Code)
+
+	w = storageRequest("GET", "/", "", nil)
+	json.Unmarshal(w.Body.Bytes(), &listing)
+	moduleVersion := listing["module/"]
+	storageRequest("PUT", "/module/dir/other-file.txt", "other text", nil)
+	w = storageRequest("GET", "/", "", nil)
+	json.Unmarshal(w.Body.Bytes(), &listing)
+	assert.NotEqual(moduleVersion, listing["module/"])
+
+	w = storageRequest("GET", "/module/notexisting/", "", nil)
+	assert.Equal(404, w.Code)
+	assert.Equal("{\n}\n", w.Body.String())
+}
+
+func TestS3StorageDelete(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	fake, done := withS3Storage(t)
+	defer done()
+
+	storageRequest("PUT", "/module/file.txt", "text", nil)
+	w := storageRequest("PUT", "/module/dir/new-file.txt", "new text", nil)
+	etag := w.Header().Get("ETag")
+
+	w = storageRequest("DELETE", "/module/dir/new-file.txt", "", map[string]string{"If-Match": "invalid"})
+	assert.Equal(412, w.Code)
+	w = storageRequest("DELETE", "/module/dir/new-file.txt", "", nil)
+	assert.Equal(200, w.Code)
+	assert.Equal(etag, w.Header().Get("ETag"))
+	_, markerExists := fake.objects["user1/module/dir/" + S3_FOLDER_MARKER]
+	assert.True(!markerExists)
+
+	w = storageRequest("GET", "/module/", "", nil)
+	var listing map[string]string
+	json.Unmarshal(w.Body.Bytes(), &listing)
+	assert.Equal(1, len(listing))
+	assert.Equal("", listing["dir/"])
+
+	w = storageRequest("DELETE", "/module/dir/new-file.txt", "", nil)
+	assert.Equal(404, w.Code)
+}
+
+func TestS3Escape(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	assert.Equal("/gors/user1/a%20b%2Bc/~file.txt", s3Escape("/gors/user1/a b+c/~file.txt"))
+	assert.Equal("delimiter=%2F&list-type=2&prefix=user1%2Fmodule%2F", canonicalS3Query(map[string][]string{
+		"prefix": {"user1/module/"}, "delimiter": {"/"}, "list-type": {"2"},
+	}))
+}
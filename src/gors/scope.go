@@ -0,0 +1,136 @@
+package gors
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+/* ------------------------------------ Scopes ----------------------------- */
+
+// A scope string is a space separated list of scopes in the form module:r or module:rw.
+// The module "*" (or "root", used by older clients) grants access to all modules,
+// a bare "root" is the same as "root:rw".
+
+const ROOT_SCOPE = "root"
+
+const (
+	READ_ACCESS       = "r"
+	READ_WRITE_ACCESS = "rw"
+)
+
+var MODULE_NAME_PATTERN = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+type Scope struct {
+	path  string;
+	write bool
+}
+
+func (s Scope) String() string {
+	name := s.path
+	if s.path == ROOT_SCOPE {
+		name = "All Modules"
+	}
+	if (s.write) {
+		return name + " (Full Access)"
+	}
+	return name
+}
+
+// covers checks if the path in the storage of a user belongs to the module of the scope.
+func (s Scope) covers(pathInUserStorage string) bool {
+	return s.path == ROOT_SCOPE ||
+		strings.HasPrefix(pathInUserStorage, "/" + s.path + "/") ||
+		strings.HasPrefix(pathInUserStorage, "/public/" + s.path + "/")
+}
+
+// requiredScope returns the scope, which an app needs to read (or write) the path in the storage of a user.
+func requiredScope(pathInUserStorage string, write bool) Scope {
+	parts := strings.Split(strings.TrimPrefix(pathInUserStorage, "/"), "/")
+	if parts[0] == "public" && len(parts) > 2 {
+		parts = parts[1:]
+	}
+	if len(parts) < 2 || parts[0] == "public" || !MODULE_NAME_PATTERN.MatchString(parts[0]) {
+		return Scope{ROOT_SCOPE, write}
+	}
+	return Scope{parts[0], write}
+}
+
+// includes checks if the scope grants at least the access of the other scope.
+func (s Scope) includes(other Scope) bool {
+	return (s.path == ROOT_SCOPE || s.path == other.path) && (s.write || !other.write)
+}
+
+// formatScopes returns the scope string of the scopes.
+func formatScopes(scopes []Scope) string {
+	scopeStrings := make([]string, len(scopes))
+	for i, scope := range scopes {
+		scopeStrings[i] = scope.path + ":" + READ_ACCESS
+		if scope.write {
+			scopeStrings[i] = scope.path + ":" + READ_WRITE_ACCESS
+		}
+	}
+	return strings.Join(scopeStrings, " ")
+}
+
+// parseScopes parses a scope string and merges scopes, which are included in others
+// (e.g. "contacts:r contacts:rw" becomes "contacts:rw").
+func parseScopes(scopesString string) ([]Scope, error) {
+	scopeStrings := strings.Fields(scopesString)
+	if len(scopeStrings) == 0 {
+		return nil, errors.New("No scope requested")
+	}
+	parsedScopes := make([]Scope, 0, len(scopeStrings))
+	for _, scopeString := range scopeStrings {
+		scope, err := parseScope(scopeString)
+		if err != nil {
+			return nil, err
+		}
+		parsedScopes = append(parsedScopes, scope)
+	}
+
+	scopes := make([]Scope, 0, len(parsedScopes))
+	for i, scope := range parsedScopes {
+		if !isIncludedInOtherScope(scope, i, parsedScopes) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+func parseScope(scopeString string) (Scope, error) {
+	if scopeString == ROOT_SCOPE {
+		return Scope{ROOT_SCOPE, true}, nil
+	}
+	parts := strings.Split(scopeString, ":")
+	if len(parts) != 2 {
+		return Scope{}, errors.New("Invalid scope: " + scopeString)
+	}
+	module := parts[0]
+	if module == "*" {
+		module = ROOT_SCOPE
+	} else if !MODULE_NAME_PATTERN.MatchString(module) || module == "public" {
+		return Scope{}, errors.New("Invalid module in scope: " + scopeString)
+	}
+	switch parts[1] {
+	case READ_ACCESS:
+		return Scope{module, false}, nil
+	case READ_WRITE_ACCESS:
+		return Scope{module, true}, nil
+	}
+	return Scope{}, errors.New("Invalid access mode in scope: " + scopeString)
+}
+
+// isIncludedInOtherScope checks if the scope at index i is included in another scope.
+// Of equal scopes only the first one is kept.
+func isIncludedInOtherScope(scope Scope, i int, scopes []Scope) bool {
+	for j, other := range scopes {
+		if j == i || !other.includes(scope) {
+			continue
+		}
+		if other != scope || j < i {
+			return true
+		}
+	}
+	return false
+}
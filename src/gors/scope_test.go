@@ -0,0 +1,86 @@
+package gors
+
+import (
+	"testing"
+	"libs/assrt"
+)
+
+func TestScopes(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	scopes, err := parseScopes("name1:rw name2:r")
+	assert.Nil(err)
+	assert.Equal([]Scope{Scope{"name1", true}, Scope{"name2", false}}, scopes)
+}
+
+func TestParseScopes(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	for _, test := range []struct {
+		scope  string
+		scopes []Scope
+	}{
+		{"contacts:r", []Scope{Scope{"contacts", false}}},
+		{"contacts:rw", []Scope{Scope{"contacts", true}}},
+		{"my_module-2:rw", []Scope{Scope{"my_module-2", true}}},
+		{"  contacts:r   calendar:rw ", []Scope{Scope{"contacts", false}, Scope{"calendar", true}}},
+		{"*:rw", []Scope{Scope{ROOT_SCOPE, true}}},
+		{"*:r", []Scope{Scope{ROOT_SCOPE, false}}},
+		{"root", []Scope{Scope{ROOT_SCOPE, true}}},
+		{"root:r", []Scope{Scope{ROOT_SCOPE, false}}},
+		{"contacts:r contacts:r", []Scope{Scope{"contacts", false}}},
+		{"contacts:r contacts:rw", []Scope{Scope{"contacts", true}}},
+		{"contacts:rw contacts:r", []Scope{Scope{"contacts", true}}},
+		{"contacts:rw *:rw", []Scope{Scope{ROOT_SCOPE, true}}},
+		{"*:r contacts:r", []Scope{Scope{ROOT_SCOPE, false}}},
+		{"*:r contacts:rw", []Scope{Scope{ROOT_SCOPE, false}, Scope{"contacts", true}}},
+		{"root:r *:r", []Scope{Scope{ROOT_SCOPE, false}}},
+	} {
+		scopes, err := parseScopes(test.scope)
+		assert.Nil(err, test.scope)
+		assert.Equal(test.scopes, scopes, test.scope)
+	}
+}
+
+func TestParseInvalidScopes(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	for _, scope := range []string{
+		"",
+		"   ",
+		"contacts",
+		"contacts:",
+		":rw",
+		"contacts:w",
+		"contacts:RW",
+		"contacts:rw:r",
+		"Contacts:rw",
+		"con/tacts:rw",
+		"..:rw",
+		"public:rw",
+		"contacts:rw,calendar:r",
+		"contacts:rw calendar",
+		"**:rw",
+	} {
+		scopes, err := parseScopes(scope)
+		assert.NotNil(err, scope)
+		assert.Nil(scopes, scope)
+	}
+}
+
+func TestScopeCovers(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	contacts := Scope{"contacts", false}
+	assert.True(contacts.covers("/contacts/"))
+	assert.True(contacts.covers("/contacts/card.json"))
+	assert.True(contacts.covers("/public/contacts/card.json"))
+	assert.True(!contacts.covers("/contacts"))
+	assert.True(!contacts.covers("/contactsX/card.json"))
+	assert.True(!contacts.covers("/calendar/event.json"))
+	assert.True(Scope{ROOT_SCOPE, false}.covers("/calendar/event.json"))
+	assert.True(!Scope{"rootbeer", true}.covers("/calendar/event.json"))
+}
+
+func TestScopeString(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	assert.Equal("contacts", Scope{"contacts", false}.String())
+	assert.Equal("contacts (Full Access)", Scope{"contacts", true}.String())
+	assert.Equal("All Modules (Full Access)", Scope{ROOT_SCOPE, true}.String())
+}
@@ -0,0 +1,182 @@
+package gors
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/* ------------------------------------ Sessions ----------------------------- */
+
+// After a successful login the browser gets a session cookie for the gors pages,
+// so the user doesn't need to type the password again while the session lasts.
+
+const SESSION_COOKIE_NAME = "gors_session"
+
+const SESSION_LIFETIME = 7 * 24 * time.Hour
+
+type session struct {
+	username string
+	expires  time.Time
+}
+
+var sessionsById = make(map[string]*session)
+var sessionsMutex sync.Mutex
+
+func startSession(w http.ResponseWriter, r *http.Request, username string) {
+	sessionId := hex.EncodeToString(randomBytes(32))
+	expires := time.Now().Add(SESSION_LIFETIME)
+
+	sessionsMutex.Lock()
+	for id, oldSession := range sessionsById {
+		if time.Now().After(oldSession.expires) {
+			delete(sessionsById, id)
+		}
+	}
+	sessionsById[sessionId] = &session{username, expires}
+	sessionsMutex.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE_NAME,
+		Value:    sessionId,
+		Path:     GORS_PATH + "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func endSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(SESSION_COOKIE_NAME); err == nil {
+		sessionsMutex.Lock()
+		delete(sessionsById, cookie.Value)
+		sessionsMutex.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE_NAME, Path: GORS_PATH + "/", MaxAge: -1})
+}
+
+// endUserSessions ends all sessions of the user except the one with the id keepSessionId (e.g. after a password change).
+func endUserSessions(username string, keepSessionId string) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	for id, userSession := range sessionsById {
+		if userSession.username == username && id != keepSessionId {
+			delete(sessionsById, id)
+		}
+	}
+}
+
+// requestSessionId returns the id of the session cookie of the request ("" if there is none).
+func requestSessionId(r *http.Request) string {
+	cookie, err := r.Cookie(SESSION_COOKIE_NAME)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// sessionUsername returns the user, who is logged in with the session cookie of the request ("" if nobody).
+func sessionUsername(r *http.Request) string {
+	cookie, err := r.Cookie(SESSION_COOKIE_NAME)
+	if err != nil {
+		return ""
+	}
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	session := sessionsById[cookie.Value]
+	if session == nil || time.Now().After(session.expires) {
+		return ""
+	}
+	return session.username
+}
+
+/* ------------------------------------ Consents ----------------------------- */
+
+// The scopes, which a user allowed an app to access, are stored per origin of the app in the .gors folder of the user.
+// The origin is the one of the verified redirect_uri (not the client_id, which may be only the host), so
+// a consent given to https://example.com doesn't allow http://example.com to receive tokens without asking.
+
+const CONSENTS_FILE_NAME = "consents.json"
+
+var consentsMutex sync.Mutex
+
+func readConsents(username string) (map[string]string, error) {
+	consents := make(map[string]string)
+	content, err := ioutil.ReadFile(userGorsDir(username) + CONSENTS_FILE_NAME)
+	if os.IsNotExist(err) {
+		return consents, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return consents, json.Unmarshal(content, &consents)
+}
+
+// hasConsent checks if the user allowed the app to access all the scopes before.
+func hasConsent(username string, origin string, scopes []Scope) bool {
+	consentsMutex.Lock()
+	consents, err := readConsents(username)
+	consentsMutex.Unlock()
+	if err != nil {
+		return false
+	}
+	allowedScopes, err := parseScopes(consents[origin])
+	if err != nil {
+		return false
+	}
+	for _, scope := range scopes {
+		if !isScopeIncluded(scope, allowedScopes) {
+			return false
+		}
+	}
+	return true
+}
+
+// addConsent merges the scopes into the scopes, which the user allowed the app to access.
+func addConsent(username string, origin string, scopes []Scope) error {
+	consentsMutex.Lock()
+	defer consentsMutex.Unlock()
+	consents, err := readConsents(username)
+	if err != nil {
+		consents = make(map[string]string)
+	}
+	mergedScopes, err := parseScopes(consents[origin] + " " + formatScopes(scopes))
+	if err != nil {
+		return err
+	}
+	consents[origin] = formatScopes(mergedScopes)
+	content, err := json.MarshalIndent(consents, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := userGorsDir(username) + CONSENTS_FILE_NAME
+	if err := ioutil.WriteFile(filename, content, 0600); err != nil {
+		return err
+	}
+	chownIfNeeded(filename, username)
+	return nil
+}
+
+// removeConsents forgets all apps, which the user allowed access, so they need a new login.
+func removeConsents(username string) error {
+	consentsMutex.Lock()
+	defer consentsMutex.Unlock()
+	err := os.Remove(userGorsDir(username) + CONSENTS_FILE_NAME)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func isScopeIncluded(scope Scope, scopes []Scope) bool {
+	for _, other := range scopes {
+		if other.includes(scope) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package gors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"libs/assrt"
+)
+
+// login allows access with the password and returns the cookies of the browser afterwards.
+func login(assert *assrt.Assert, query string) []*http.Cookie {
+	r, _ := http.NewRequest("GET", AUTH_PATH + "user1" + query, nil)
+	w := httptest.NewRecorder()
+	handleAuth(w, r)
+	cookies := w.Result().Cookies()
+	match := CSRF_TOKEN_INPUT_PATTERN.FindStringSubmatch(w.Body.String())
+	assert.MustNotNil(match)
+	w = postAuthForm(AUTH_PATH + "user1" + query, url.Values{"password": {"password"}, CSRF_TOKEN_FIELD: {match[1]}}, cookies)
+	assert.MustEqual(303, w.Code)
+	return append(cookies, w.Result().Cookies()...)
+}
+
+func authWithCookies(urlString string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	return getWithCookies(handleAuth, urlString, cookies)
+}
+
+func TestRememberedConsent(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+
+	cookies := login(assert, AUTH_QUERY)
+	hasSessionCookie := false
+	for _, cookie := range cookies {
+		if cookie.Name == SESSION_COOKIE_NAME {
+			hasSessionCookie = true
+			assert.True(cookie.HttpOnly)
+		}
+	}
+	assert.True(hasSessionCookie)
+
+	// same scopes are allowed automatically
+	w := authWithCookies(AUTH_PATH + "user1" + AUTH_QUERY + "&state=1", cookies)
+	assert.Equal(302, w.Code)
+	location := w.Header().Get("Location")
+	assert.True(strings.HasPrefix(location, "https://app.example.com/#access_token="), location)
+	assert.True(strings.HasSuffix(location, "&state=1"), location)
+
+	// narrower scopes too
+	w = authWithCookies(AUTH_PATH + "user1" + strings.Replace(AUTH_QUERY, "module%3Arw", "module%3Ar", 1), cookies)
+	assert.Equal(302, w.Code)
+
+	// other scopes need consent, but no password
+	upgradeQuery := strings.Replace(AUTH_QUERY, "module%3Arw", "module%3Arw+other%3Ar", 1)
+	w = authWithCookies(AUTH_PATH + "user1" + upgradeQuery, cookies)
+	assert.Equal(200, w.Code)
+	assert.True(strings.Contains(w.Body.String(), "Logged in as user1"))
+	assert.True(!strings.Contains(w.Body.String(), `name="password"`))
+	match := CSRF_TOKEN_INPUT_PATTERN.FindStringSubmatch(w.Body.String())
+	assert.MustNotNil(match)
+	w = postAuthForm(AUTH_PATH + "user1" + upgradeQuery, url.Values{CSRF_TOKEN_FIELD: {match[1]}}, cookies)
+	assert.Equal(303, w.Code)
+	assert.True(strings.HasPrefix(w.Header().Get("Location"), "https://app.example.com/#access_token="))
+
+	w = authWithCookies(AUTH_PATH + "user1" + upgradeQuery, cookies)
+	assert.Equal(302, w.Code)
+	consents, _ := readConsents("user1")
+	assert.Equal(map[string]string{"https://app.example.com": "module:rw other:r"}, consents)
+
+	// other apps need consent
+	otherAppQuery := "?redirect_uri=https%3A%2F%2Fother.example.com%2F&client_id=other.example.com&scope=module%3Arw"
+	w = authWithCookies(AUTH_PATH + "user1" + otherAppQuery, cookies)
+	assert.Equal(200, w.Code)
+}
+
+func TestRememberedConsentIsPerOrigin(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+
+	// the client_id of older apps is only the host, which matches http and https
+	httpsQuery := "?redirect_uri=https%3A%2F%2Fapp.example.com%2F&client_id=app.example.com&scope=module%3Arw"
+	cookies := login(assert, httpsQuery)
+	consents, _ := readConsents("user1")
+	assert.Equal(map[string]string{"https://app.example.com": "module:rw"}, consents)
+	w := authWithCookies(AUTH_PATH + "user1" + httpsQuery, cookies)
+	assert.Equal(302, w.Code)
+
+	httpQuery := strings.Replace(httpsQuery, "https", "http", 1)
+	w = authWithCookies(AUTH_PATH + "user1" + httpQuery, cookies)
+	assert.Equal(200, w.Code)
+	assert.True(w.Header().Get("Location") == "")
+}
+
+func TestSessionIsNeededForRememberedConsent(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+
+	cookies := login(assert, AUTH_QUERY)
+
+	w := authWithCookies(AUTH_PATH + "user1" + AUTH_QUERY, nil)
+	assert.Equal(200, w.Code)
+	assert.True(strings.Contains(w.Body.String(), `name="password"`))
+
+	w = authWithCookies(AUTH_PATH + "user1" + AUTH_QUERY, []*http.Cookie{&http.Cookie{Name: SESSION_COOKIE_NAME, Value: "unknown"}})
+	assert.Equal(200, w.Code)
+
+	for _, cookie := range cookies {
+		if cookie.Name == SESSION_COOKIE_NAME {
+			sessionsById[cookie.Value].expires = time.Now().Add(-time.Second)
+		}
+	}
+	w = authWithCookies(AUTH_PATH + "user1" + AUTH_QUERY, cookies)
+	assert.Equal(200, w.Code)
+
+	// a session of user1 is no session of user2
+	cookies = login(assert, AUTH_QUERY)
+	os.MkdirAll(userGorsDir("user2"), os.ModePerm)
+	addConsent("user2", "https://app.example.com", []Scope{Scope{"module", true}})
+	w = authWithCookies(AUTH_PATH + "user2" + AUTH_QUERY, cookies)
+	assert.Equal(200, w.Code)
+	assert.True(strings.Contains(w.Body.String(), `name="password"`))
+}
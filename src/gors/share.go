@@ -0,0 +1,481 @@
+package gors
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"libs/bcrypt"
+)
+
+/* ------------------------------------ Share Links ----------------------------- */
+
+// Users (on the dashboard) and apps with write access can share single documents or folders of their storage
+// by a link, which is valid until it expires or is revoked on the dashboard. Links can be protected by a password.
+// The shares are stored in .gors/shares.json together with a random key of the user, which signs the links,
+// so links can't be guessed or changed (e.g. to another path or a later expiry).
+//
+// Link: SHARE_PATH <username>/<share id>.<signature>/<name of the document or path in the folder>
+
+var SHARE_PATH = GORS_PATH + "/share/"
+
+const SHARES_FILE_NAME = "shares.json"
+
+const SHARE_COOKIE_PREFIX = "gors_share_"
+
+const (
+	DEFAULT_SHARE_LIFETIME = 7 * 24 * time.Hour
+	MAX_SHARE_LIFETIME     = 365 * 24 * time.Hour
+)
+
+// creator of shares, which were created on the dashboard instead of by an app
+const DASHBOARD_CREATOR = "dashboard"
+
+type share struct {
+	Path    string    `json:"path"`
+	Expires time.Time `json:"expires"`
+	// bcrypt hash, "" for shares without password
+	PasswordHash string `json:"passwordHash,omitempty"`
+	// client_id of the app or DASHBOARD_CREATOR
+	CreatedBy string `json:"createdBy"`
+	// wrong passwords, so they can't be guessed
+	attemptLimit
+}
+
+type userShares struct {
+	Key    []byte            `json:"key"`
+	Shares map[string]*share `json:"shares"`
+}
+
+var sharesMutex sync.Mutex
+
+func readShares(username string) (*userShares, error) {
+	shares := &userShares{Shares: map[string]*share{}}
+	sharesJson, err := ioutil.ReadFile(userGorsDir(username) + SHARES_FILE_NAME)
+	if os.IsNotExist(err) {
+		return shares, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(sharesJson, shares); err != nil {
+		return nil, err
+	}
+	if shares.Shares == nil {
+		shares.Shares = map[string]*share{}
+	}
+	return shares, nil
+}
+
+func writeShares(username string, shares *userShares) error {
+	sharesJson, err := json.Marshal(shares)
+	if err != nil {
+		return err
+	}
+	filename := userGorsDir(username) + SHARES_FILE_NAME
+	if err := ioutil.WriteFile(filename, sharesJson, 0600); err != nil {
+		return err
+	}
+	chownIfNeeded(filename, username)
+	return nil
+}
+
+// cleanSharePath returns the path in the storage of the user as "/module/document" or "/module/folder/".
+func cleanSharePath(sharePath string) (string, error) {
+	sharePath = strings.TrimSpace(sharePath)
+	if !strings.HasPrefix(sharePath, "/") {
+		sharePath = "/" + sharePath
+	}
+	cleanPath := path.Clean(sharePath)
+	if strings.HasSuffix(sharePath, "/") && cleanPath != "/" {
+		cleanPath += "/"
+	}
+	if cleanPath != sharePath {
+		return "", errors.New("Invalid path: " + sharePath)
+	}
+	return cleanPath, nil
+}
+
+// createShare returns the token (share id and signature) for the link to a document or folder.
+func createShare(username string, sharePath string, lifetime time.Duration, password string, createdBy string) (string, *share, error) {
+	sharePath, err := cleanSharePath(sharePath)
+	if err != nil {
+		return "", nil, err
+	}
+	if lifetime <= 0 || lifetime > MAX_SHARE_LIFETIME {
+		return "", nil, errors.New("Share links expire after at most " + strconv.Itoa(int(MAX_SHARE_LIFETIME / (24 * time.Hour))) + " days.")
+	}
+	if isDirListingRequest(sharePath) {
+		if items, err := storage.List(username, sharePath); err != nil || len(items) == 0 {
+			return "", nil, errors.New("There is no folder " + sharePath)
+		}
+	} else if item, err := storage.Stat(username, sharePath); err != nil || item.IsDir {
+		return "", nil, errors.New("There is no document " + sharePath)
+	}
+	newShare := &share{Path: sharePath, Expires: time.Now().Add(lifetime), CreatedBy: createdBy}
+	if password != "" {
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", nil, err
+		}
+		newShare.PasswordHash = string(passwordHash)
+	}
+
+	sharesMutex.Lock()
+	defer sharesMutex.Unlock()
+	shares, err := readShares(username)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(shares.Key) == 0 {
+		shares.Key = randomBytes(32)
+	}
+	for id, oldShare := range shares.Shares {
+		if time.Now().After(oldShare.Expires) {
+			delete(shares.Shares, id)
+		}
+	}
+	id := hex.EncodeToString(randomBytes(8))
+	shares.Shares[id] = newShare
+	if err := writeShares(username, shares); err != nil {
+		return "", nil, err
+	}
+	return shareToken(shares.Key, id, newShare), newShare, nil
+}
+
+func revokeShare(username string, id string) error {
+	sharesMutex.Lock()
+	defer sharesMutex.Unlock()
+	shares, err := readShares(username)
+	if err != nil {
+		return err
+	}
+	if shares.Shares[id] == nil {
+		return errors.New("Unknown share: " + id)
+	}
+	delete(shares.Shares, id)
+	return writeShares(username, shares)
+}
+
+func shareToken(key []byte, id string, s *share) string {
+	return id + "." + shareSignature(key, id, s)
+}
+
+func shareSignature(key []byte, id string, s *share) string {
+	return base64.RawURLEncoding.EncodeToString(hmacSha256(key, id + "\n" + s.Path + "\n" + strconv.FormatInt(s.Expires.Unix(), 10)))
+}
+
+// findShare returns the share of a link token, if it's valid and not expired.
+func findShare(username string, token string) (string, *share, []byte) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", nil, nil
+	}
+	sharesMutex.Lock()
+	shares, err := readShares(username)
+	sharesMutex.Unlock()
+	if err != nil {
+		fmt.Println("Error", err)
+		return "", nil, nil
+	}
+	s := shares.Shares[parts[0]]
+	if s == nil || time.Now().After(s.Expires) ||
+			!hmac.Equal([]byte(parts[1]), []byte(shareSignature(shares.Key, parts[0], s))) {
+		return "", nil, nil
+	}
+	return parts[0], s, shares.Key
+}
+
+// shareUrlPath is the path of the link to the share (with the name of the document, so downloads get it).
+// The segments are escaped, because names may contain characters like ? or #.
+func shareUrlPath(username string, token string, s *share) string {
+	urlPath := SHARE_PATH + url.PathEscape(username) + "/" + token + "/"
+	if !isDirListingRequest(s.Path) {
+		urlPath += url.PathEscape(path.Base(s.Path))
+	}
+	return urlPath
+}
+
+// The cookie proves, that the browser knows the password of the share (until the password or the share changes).
+func shareCookieValue(key []byte, id string, s *share) string {
+	return hex.EncodeToString(hmacSha256(key, "unlocked\n" + id + "\n" + s.PasswordHash))
+}
+
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(r.URL.Path[len(SHARE_PATH):], "/", 3)
+	if len(parts) == 1 {
+		handleCreateShare(w, r, parts[0])
+		return
+	}
+	username := parts[0]
+	token := parts[1]
+	if !userExists(username) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	id, s, key := findShare(username, token)
+	if s == nil {
+		setFrameBustingHeaders(w)
+		renderAuthError(w, 404, "This share link is not valid (anymore).")
+		return
+	}
+	if len(parts) == 2 {
+		http.Redirect(w, r, shareUrlPath(username, token, s), 302)
+		return
+	}
+	shareUrl := SHARE_PATH + url.PathEscape(username) + "/" + token + "/"
+
+	if s.PasswordHash != "" {
+		cookieName := SHARE_COOKIE_PREFIX + id
+		cookie, err := r.Cookie(cookieName)
+		if err != nil || !hmac.Equal([]byte(cookie.Value), []byte(shareCookieValue(key, id, s))) {
+			handleSharePassword(w, r, username, id, cookieName, shareCookieValue(key, id, s), shareUrl, s)
+			return
+		}
+	}
+	if r.Method == "POST" {
+		http.Redirect(w, r, r.URL.Path, 303)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private")
+	relativePath := parts[2]
+	if !isDirListingRequest(s.Path) {
+		if relativePath != "" && relativePath != path.Base(s.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		serveSharedDocument(w, r, username, s.Path)
+		return
+	}
+	targetPath := s.Path + relativePath
+	if cleanPath, err := cleanSharePath(targetPath); err != nil || cleanPath != targetPath {
+		http.NotFound(w, r)
+		return
+	}
+	// meta files (e.g. the content types) aren't part of the shared folder
+	for _, segment := range strings.Split(targetPath, "/") {
+		if isMetaFile(segment) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if isDirListingRequest(targetPath) {
+		serveSharedFolder(w, r, username, targetPath, relativePath)
+	} else {
+		serveSharedDocument(w, r, username, targetPath)
+	}
+}
+
+func serveSharedDocument(w http.ResponseWriter, r *http.Request, username string, documentPath string) {
+	// documents (e.g. HTML) must not run scripts in the origin of gors
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	handleGetFile(w, r, username, documentPath)
+}
+
+type sharedFolderEntry struct {
+	Name string
+	Href string
+}
+
+func serveSharedFolder(w http.ResponseWriter, r *http.Request, username string, folderPath string, relativePath string) {
+	items, err := storage.List(username, folderPath)
+	if err != nil || len(items) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = itemName(item)
+	}
+	sort.Strings(names)
+	entries := make([]sharedFolderEntry, len(names))
+	for i, name := range names {
+		// folders keep their trailing slash unescaped, so relative links work in them
+		entries[i] = sharedFolderEntry{name, url.PathEscape(strings.TrimSuffix(name, "/"))}
+		if strings.HasSuffix(name, "/") {
+			entries[i].Href += "/"
+		}
+	}
+	setFrameBustingHeaders(w)
+	renderTemplate(w, "share.html", map[string]interface{} {
+		"folder": relativePath,
+		"isSubfolder": relativePath != "",
+		"entries": entries,
+	})
+}
+
+// handleSharePassword asks for the password of a share. After too many wrong passwords the share is locked for a while.
+func handleSharePassword(w http.ResponseWriter, r *http.Request, username string, id string, cookieName string, cookieValue string, shareUrl string, s *share) {
+	setFrameBustingHeaders(w)
+	w.Header().Set("Cache-Control", "no-store")
+	data := map[string]interface{} {
+		"passwordNeeded": true,
+	}
+	if r.Method == "POST" {
+		if !isCsrfTokenValid(r) {
+			renderAuthError(w, 403, "The form has expired. Please reload the page and try again.")
+			return
+		}
+		if s.isLocked(time.Now()) {
+			data["error"] = "Too many wrong passwords. Try again in a few minutes!"
+			data["csrfToken"] = csrfToken(w, r)
+			w.WriteHeader(429)
+			renderTemplate(w, "share.html", data)
+			return
+		}
+		isValid := bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(r.PostFormValue("password"))) == nil
+		addSharePasswordAttempt(username, id, isValid)
+		if isValid {
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookieName,
+				Value:    cookieValue,
+				Path:     shareUrl,
+				Expires:  s.Expires,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, r.URL.Path, 303)
+			return
+		}
+		data["error"] = "Wrong Password. Try again!"
+	}
+	data["csrfToken"] = csrfToken(w, r)
+	w.WriteHeader(401)
+	renderTemplate(w, "share.html", data)
+}
+
+// addSharePasswordAttempt counts the wrong passwords of a share and resets them after a valid one.
+func addSharePasswordAttempt(username string, id string, isValid bool) {
+	sharesMutex.Lock()
+	defer sharesMutex.Unlock()
+	shares, err := readShares(username)
+	if err != nil {
+		fmt.Println("Error", err)
+		return
+	}
+	s := shares.Shares[id]
+	if s == nil || (isValid && s.FailedAttempts == 0) {
+		return
+	}
+	if isValid {
+		s.addSuccess()
+	} else {
+		s.addFailure(time.Now())
+	}
+	if err := writeShares(username, shares); err != nil {
+		fmt.Println("Error", err)
+	}
+}
+
+/* ---- Shares of Apps ---- */
+
+type shareResponse struct {
+	Url     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// handleCreateShare lets apps with write access to a path create a share link for it by a POST
+// with path, expires_in (seconds, DEFAULT_SHARE_LIFETIME if missing) and an optional password.
+func handleCreateShare(w http.ResponseWriter, r *http.Request, username string) {
+	enableCORS(w, r)
+	w.Header().Set("access-control-allow-methods", "POST")
+
+	if (r.Method == "OPTIONS") {
+		return;
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	r.ParseForm()
+	sharePath, err := cleanSharePath(r.PostForm.Get("path"))
+	if err != nil {
+		writeShareError(w, err.Error())
+		return
+	}
+	// POST needs write access like PUT
+	authorization, authError := getAuthorization(r, username, sharePath)
+	if authorization == nil {
+		writeBearerChallenge(w, authError, requiredScope(sharePath, true))
+		return
+	}
+	lifetime := DEFAULT_SHARE_LIFETIME
+	if expiresIn := r.PostForm.Get("expires_in"); expiresIn != "" {
+		seconds, err := strconv.ParseInt(expiresIn, 10, 64)
+		if err != nil || seconds <= 0 || seconds > int64(MAX_SHARE_LIFETIME / time.Second) {
+			writeShareError(w, "Invalid expires_in: " + expiresIn)
+			return
+		}
+		lifetime = time.Duration(seconds) * time.Second
+	}
+
+	token, s, err := createShare(username, sharePath, lifetime, r.PostForm.Get("password"), authorization.clientId)
+	if err != nil {
+		writeShareError(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shareResponse{getBaseUrl(r) + shareUrlPath(username, token, s), s.Expires})
+}
+
+func writeShareError(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request", "error_description": message})
+}
+
+/* ---- Dashboard ---- */
+
+// sharedLink describes a share for the dashboard.
+type sharedLink struct {
+	Id          string
+	Path        string
+	Url         string
+	Expires     string
+	CreatedBy   string
+	HasPassword bool
+}
+
+func listShares(r *http.Request, username string) ([]sharedLink, error) {
+	sharesMutex.Lock()
+	shares, err := readShares(username)
+	sharesMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	links := []sharedLink{}
+	for id, s := range shares.Shares {
+		if time.Now().After(s.Expires) {
+			continue
+		}
+		token := shareToken(shares.Key, id, s)
+		links = append(links, sharedLink{id, s.Path, getBaseUrl(r) + shareUrlPath(username, token, s),
+			s.Expires.Format("2006-01-02 15:04"), s.CreatedBy, s.PasswordHash != ""})
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Path < links[j].Path })
+	return links, nil
+}
@@ -0,0 +1,282 @@
+package gors
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"libs/assrt"
+)
+
+func withSharedDocuments(t *testing.T) func() {
+	done := withAuthUser1(t)
+	for _, path := range []string{"module/file.txt", "module/folder/a.txt", "module/folder/sub/b.html", "other/secret.txt"} {
+		if _, err := storage.Put("user1", "/" + path, strings.NewReader("content of " + path), &Item{ContentType: "text/plain"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return done
+}
+
+func TestShareDocument(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withSharedDocuments(t)
+	defer done()
+
+	token, s, err := createShare("user1", "module/file.txt", time.Hour, "", DASHBOARD_CREATOR)
+	assert.MustNil(err)
+	link := shareUrlPath("user1", token, s)
+	assert.Equal(SHARE_PATH + "user1/" + token + "/file.txt", link)
+
+	w := getWithCookies(handleShare, link, nil)
+	assert.Equal(200, w.Code)
+	assert.Equal("content of module/file.txt", w.Body.String())
+	assert.Equal("sandbox", w.Header().Get("Content-Security-Policy"))
+	assert.Equal("no-referrer", w.Header().Get("Referrer-Policy"))
+
+	w = getWithCookies(handleShare, SHARE_PATH + "user1/" + token, nil)
+	assert.Equal(302, w.Code)
+	assert.Equal(link, w.Header().Get("Location"))
+
+	id := strings.Split(token, ".")[0]
+	for _, invalidLink := range []string{
+		SHARE_PATH + "user1/" + token + "/other.txt",
+		SHARE_PATH + "user1/" + token + "x/file.txt",
+		SHARE_PATH + "user1/" + id + "/file.txt",
+		SHARE_PATH + "user1/" + id + ".AAAA/file.txt",
+		SHARE_PATH + "user2/" + token + "/file.txt",
+	} {
+		w := getWithCookies(handleShare, invalidLink, nil)
+		assert.Equal(404, w.Code, invalidLink)
+	}
+	r, _ := http.NewRequest("PUT", link, strings.NewReader("changed"))
+	w = httptest.NewRecorder()
+	handleShare(w, r)
+	assert.Equal(405, w.Code)
+
+	assert.MustNil(revokeShare("user1", id))
+	w = getWithCookies(handleShare, link, nil)
+	assert.Equal(404, w.Code)
+	assert.NotNil(revokeShare("user1", id))
+
+	token, s, err = createShare("user1", "/module/file.txt", -time.Hour, "", DASHBOARD_CREATOR)
+	assert.NotNil(err)
+	token, s, err = createShare("user1", "/module/file.txt", time.Hour, "", DASHBOARD_CREATOR)
+	assert.MustNil(err)
+	sharesMutex.Lock()
+	shares, _ := readShares("user1")
+	shares.Shares[strings.Split(token, ".")[0]].Expires = time.Now().Add(-time.Second)
+	writeShares("user1", shares)
+	sharesMutex.Unlock()
+	w = getWithCookies(handleShare, shareUrlPath("user1", token, s), nil)
+	assert.Equal(404, w.Code)
+}
+
+func TestShareFolder(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withSharedDocuments(t)
+	defer done()
+
+	for _, path := range []string{"module/folder", "module/../other/", "module/unknown/", "module/unknown.txt", "module//folder/"} {
+		_, _, err := createShare("user1", path, time.Hour, "", DASHBOARD_CREATOR)
+		assert.NotNil(err, path)
+	}
+	token, s, err := createShare("user1", "module/folder/", time.Hour, "", DASHBOARD_CREATOR)
+	assert.MustNil(err)
+	link := shareUrlPath("user1", token, s)
+	assert.Equal(SHARE_PATH + "user1/" + token + "/", link)
+
+	w := getWithCookies(handleShare, link, nil)
+	assert.Equal(200, w.Code)
+	assert.True(strings.Contains(w.Body.String(), `href="./a.txt"`))
+	assert.True(strings.Contains(w.Body.String(), `href="./sub/"`))
+	w = getWithCookies(handleShare, link + "sub/", nil)
+	assert.Equal(200, w.Code)
+	assert.True(strings.Contains(w.Body.String(), `href="./b.html"`))
+	w = getWithCookies(handleShare, link + "sub/b.html", nil)
+	assert.Equal(200, w.Code)
+	assert.Equal("content of module/folder/sub/b.html", w.Body.String())
+	assert.Equal("sandbox", w.Header().Get("Content-Security-Policy"))
+
+	for _, invalidPath := range []string{"../file.txt", "sub/../../file.txt", "unknown.txt", "unknown/", ".rsct.a.txt", "sub/.rsct.b.html"} {
+		w := getWithCookies(handleShare, link + invalidPath, nil)
+		assert.Equal(404, w.Code, invalidPath)
+	}
+}
+
+func TestShareNamesAreEscaped(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withSharedDocuments(t)
+	defer done()
+	for _, path := range []string{"/module/odd/a?b#c%d.txt", "/module/odd/50% off/x.txt"} {
+		_, err := storage.Put("user1", path, strings.NewReader("content of " + path), &Item{ContentType: "text/plain"})
+		assert.MustNil(err)
+	}
+
+	token, s, err := createShare("user1", "module/odd/a?b#c%d.txt", time.Hour, "", DASHBOARD_CREATOR)
+	assert.MustNil(err)
+	link := shareUrlPath("user1", token, s)
+	assert.Equal(SHARE_PATH + "user1/" + token + "/a%3Fb%23c%25d.txt", link)
+	w := getWithCookies(handleShare, link, nil)
+	assert.Equal(200, w.Code)
+	assert.Equal("content of /module/odd/a?b#c%d.txt", w.Body.String())
+
+	token, s, err = createShare("user1", "module/odd/", time.Hour, "", DASHBOARD_CREATOR)
+	assert.MustNil(err)
+	link = shareUrlPath("user1", token, s)
+	w = getWithCookies(handleShare, link, nil)
+	assert.Equal(200, w.Code)
+	assert.True(strings.Contains(w.Body.String(), `href="./a%3Fb%23c%25d.txt"`), w.Body.String())
+	assert.True(strings.Contains(w.Body.String(), `href="./50%25%20off/"`), w.Body.String())
+	w = getWithCookies(handleShare, link + "a%3Fb%23c%25d.txt", nil)
+	assert.Equal("content of /module/odd/a?b#c%d.txt", w.Body.String())
+	w = getWithCookies(handleShare, link + "50%25%20off/", nil)
+	assert.Equal(200, w.Code)
+	assert.True(strings.Contains(w.Body.String(), `href="./x.txt"`))
+}
+
+func TestShareWithPassword(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withSharedDocuments(t)
+	defer done()
+
+	token, s, err := createShare("user1", "module/file.txt", time.Hour, "share password", DASHBOARD_CREATOR)
+	assert.MustNil(err)
+	link := shareUrlPath("user1", token, s)
+
+	w := getWithCookies(handleShare, link, nil)
+	assert.Equal(401, w.Code)
+	assert.True(!strings.Contains(w.Body.String(), "content of"))
+	match := CSRF_TOKEN_INPUT_PATTERN.FindStringSubmatch(w.Body.String())
+	assert.MustNotNil(match)
+	cookies := w.Result().Cookies()
+
+	w = postForm(handleShare, link, url.Values{CSRF_TOKEN_FIELD: {match[1]}, "password": {"wrong"}}, cookies)
+	assert.Equal(401, w.Code)
+	assert.True(strings.Contains(w.Body.String(), "Wrong Password"))
+	w = postForm(handleShare, link, url.Values{"password": {"share password"}}, nil)
+	assert.Equal(403, w.Code)
+
+	w = postForm(handleShare, link, url.Values{CSRF_TOKEN_FIELD: {match[1]}, "password": {"share password"}}, cookies)
+	assert.Equal(303, w.Code)
+	shareCookies := w.Result().Cookies()
+	assert.MustEqual(1, len(shareCookies))
+	assert.Equal(SHARE_PATH + "user1/" + token + "/", shareCookies[0].Path)
+
+	w = getWithCookies(handleShare, link, shareCookies)
+	assert.Equal(200, w.Code)
+	assert.Equal("content of module/file.txt", w.Body.String())
+
+	shareCookies[0].Value = strings.Repeat("0", len(shareCookies[0].Value))
+	w = getWithCookies(handleShare, link, shareCookies)
+	assert.Equal(401, w.Code)
+}
+
+func TestSharePasswordAttemptsAreLimited(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withSharedDocuments(t)
+	defer done()
+
+	token, s, err := createShare("user1", "module/file.txt", time.Hour, "share password", DASHBOARD_CREATOR)
+	assert.MustNil(err)
+	link := shareUrlPath("user1", token, s)
+	w := getWithCookies(handleShare, link, nil)
+	match := CSRF_TOKEN_INPUT_PATTERN.FindStringSubmatch(w.Body.String())
+	assert.MustNotNil(match)
+	cookies := w.Result().Cookies()
+
+	for i := 0; i < MAX_FAILED_ATTEMPTS - 1; i++ {
+		w = postForm(handleShare, link, url.Values{CSRF_TOKEN_FIELD: {match[1]}, "password": {"wrong"}}, cookies)
+		assert.Equal(401, w.Code)
+	}
+	w = postForm(handleShare, link, url.Values{CSRF_TOKEN_FIELD: {match[1]}, "password": {"share password"}}, cookies)
+	assert.Equal(303, w.Code)
+
+	for i := 0; i < MAX_FAILED_ATTEMPTS; i++ {
+		w = postForm(handleShare, link, url.Values{CSRF_TOKEN_FIELD: {match[1]}, "password": {"wrong"}}, cookies)
+		assert.Equal(401, w.Code)
+	}
+	w = postForm(handleShare, link, url.Values{CSRF_TOKEN_FIELD: {match[1]}, "password": {"share password"}}, cookies)
+	assert.Equal(429, w.Code)
+	assert.True(strings.Contains(w.Body.String(), "Too many wrong passwords"))
+
+	sharesMutex.Lock()
+	shares, _ := readShares("user1")
+	shares.Shares[strings.Split(token, ".")[0]].LockedUntil = time.Now().Unix() - 1
+	writeShares("user1", shares)
+	sharesMutex.Unlock()
+	w = postForm(handleShare, link, url.Values{CSRF_TOKEN_FIELD: {match[1]}, "password": {"share password"}}, cookies)
+	assert.Equal(303, w.Code)
+}
+
+func TestShareByApp(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withSharedDocuments(t)
+	defer done()
+	readOnly := addAuthorization(Authorization{"user1", "example.com", []Scope{Scope{"module", false}}, "read-only-token"})
+	defer removeAuthorization(readOnly.bearerToken)
+
+	createShareByApp := func(form url.Values, token string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", SHARE_PATH + "user1", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer " + token)
+		r.Host = "example.com"
+		w := httptest.NewRecorder()
+		handleShare(w, r)
+		return w
+	}
+
+	w := createShareByApp(url.Values{"path": {"/module/file.txt"}, "expires_in": {"3600"}}, "fs-token")
+	assert.MustEqual(200, w.Code)
+	var response shareResponse
+	assert.MustNil(json.Unmarshal(w.Body.Bytes(), &response))
+	assert.True(strings.HasPrefix(response.Url, "http://example.com" + SHARE_PATH + "user1/"), response.Url)
+	assert.True(response.Expires.Before(time.Now().Add(time.Hour + time.Second)))
+	w = getWithCookies(handleShare, response.Url[len("http://example.com"):], nil)
+	assert.Equal(200, w.Code)
+
+	w = createShareByApp(url.Values{"path": {"/other/secret.txt"}}, "fs-token")
+	assert.Equal(403, w.Code)
+	w = createShareByApp(url.Values{"path": {"/module/file.txt"}}, "read-only-token")
+	assert.Equal(403, w.Code)
+	w = createShareByApp(url.Values{"path": {"/module/file.txt"}}, "unknown-token")
+	assert.Equal(401, w.Code)
+	for _, form := range []url.Values{
+		{"path": {"/module/../other/secret.txt"}},
+		{"path": {"/module/unknown.txt"}},
+		{"path": {"/module/file.txt"}, "expires_in": {"0"}},
+		{"path": {"/module/file.txt"}, "expires_in": {"soon"}},
+		{"path": {"/module/file.txt"}, "expires_in": {"100000000"}},
+	} {
+		w = createShareByApp(form, "fs-token")
+		assert.Equal(400, w.Code, form)
+	}
+
+	links, err := listShares(httptest.NewRequest("GET", "/", nil), "user1")
+	assert.MustNil(err)
+	assert.MustEqual(1, len(links))
+	assert.Equal("example.com", links[0].CreatedBy)
+}
+
+func TestShareOnDashboard(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withSharedDocuments(t)
+	defer done()
+
+	_, cookies := postDashboard(assert, url.Values{"password": {"password"}}, nil)
+	page, _ := postDashboard(assert, url.Values{"action": {"create-share"}, "path": {"module/folder/"}, "days": {"7"}}, cookies)
+	assert.True(strings.Contains(page, "Share this link"), page)
+	assert.True(strings.Contains(page, "/module/folder/"))
+	page, _ = postDashboard(assert, url.Values{"action": {"create-share"}, "path": {"module/unknown/"}, "days": {"7"}}, cookies)
+	assert.True(strings.Contains(page, "There is no folder"))
+
+	links, _ := listShares(httptest.NewRequest("GET", "/", nil), "user1")
+	assert.MustEqual(1, len(links))
+	assert.Equal(DASHBOARD_CREATOR, links[0].CreatedBy)
+	page, _ = postDashboard(assert, url.Values{"action": {"revoke-share"}, "id": {links[0].Id}}, cookies)
+	links, _ = listShares(httptest.NewRequest("GET", "/", nil), "user1")
+	assert.Equal(0, len(links))
+}
@@ -0,0 +1,310 @@
+package gors
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ------------------------------------ Signed Tokens ----------------------------- */
+
+// Signed tokens contain the authorization itself (username, client_id, scopes and expiry) and are signed
+// with HMAC-SHA256, so every server with the keys can verify them without shared state. The first key signs,
+// all keys verify, so keys can be rotated by adding a new key in front and removing the old one after the token lifetime.
+// Tokens can be revoked before they expire, which is recorded in the .gors folder of the user.
+//
+// Format: v1.<key id>.<base64url payload>.<base64url signature>
+
+const SIGNED_TOKEN_VERSION = "v1"
+
+const DEFAULT_TOKEN_LIFETIME = 30 * 24 * time.Hour
+
+// key id of the key derived from the server secret, if there is no token keys file
+const SERVER_SECRET_KEY_ID = "secret"
+
+const REVOKED_TOKENS_FILE_NAME = "revoked-tokens.json"
+
+var REVOKE_PATH = GORS_PATH + "/revoke"
+
+type tokenKey struct {
+	id     string
+	secret []byte
+}
+
+var signedTokens bool
+var tokenKeys []tokenKey
+var tokenLifetime = DEFAULT_TOKEN_LIFETIME
+
+type tokenClaims struct {
+	Id       string `json:"jti"`
+	Username string `json:"sub"`
+	ClientId string `json:"cid"`
+	Scope    string `json:"scope"`
+	// in unix nanoseconds, to compare with the time of a revocation
+	IssuedAt int64 `json:"iat"`
+	// in unix seconds
+	Expires  int64 `json:"exp"`
+}
+
+func configureSignedTokens(config Config) error {
+	signedTokens = config.SignedTokens
+	tokenLifetime = config.TokenLifetime
+	if tokenLifetime <= 0 {
+		tokenLifetime = DEFAULT_TOKEN_LIFETIME
+	}
+	tokenKeys = nil
+	if !signedTokens {
+		return nil
+	}
+	if config.TokenKeysFile != "" {
+		keys, err := readTokenKeys(config.TokenKeysFile)
+		if err != nil {
+			return err
+		}
+		tokenKeys = keys
+	} else if len(serverSecret) > 0 {
+		tokenKeys = []tokenKey{{SERVER_SECRET_KEY_ID, hmacSha256(serverSecret, "gors token signing")}}
+	} else {
+		return errors.New("Signed tokens need a token keys file or a server secret")
+	}
+	return nil
+}
+
+// readTokenKeys reads lines of the form "<key id> <secret>" (the first key signs, # starts a comment).
+func readTokenKeys(filename string) ([]tokenKey, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keys := []tokenKey{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.Contains(fields[0], ".") || len(fields[1]) < 16 {
+			return nil, errors.New("Invalid token key (expected \"<key id> <secret of at least 16 characters>\"): " + fields[0])
+		}
+		keys = append(keys, tokenKey{fields[0], []byte(fields[1])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("No token keys in " + filename)
+	}
+	return keys, nil
+}
+
+func newSignedToken(username string, clientId string, scopes []Scope) string {
+	now := time.Now()
+	claims := tokenClaims{
+		Id:       hex.EncodeToString(randomBytes(16)),
+		Username: username,
+		ClientId: clientId,
+		Scope:    formatScopes(scopes),
+		IssuedAt: now.UnixNano(),
+		Expires:  now.Add(tokenLifetime).Unix(),
+	}
+	payload, _ := json.Marshal(claims)
+	key := tokenKeys[0]
+	signedPart := SIGNED_TOKEN_VERSION + "." + key.id + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signedPart + "." + base64.RawURLEncoding.EncodeToString(hmacSha256(key.secret, signedPart))
+}
+
+// verifySignedToken returns the claims of a token with a valid signature, which hasn't expired yet (revocations aren't checked).
+func verifySignedToken(token string) *tokenClaims {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || parts[0] != SIGNED_TOKEN_VERSION {
+		return nil
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil
+	}
+	signedPart := strings.Join(parts[:3], ".")
+	isValidSignature := false
+	for _, key := range tokenKeys {
+		if key.id == parts[1] {
+			isValidSignature = hmac.Equal(signature, hmacSha256(key.secret, signedPart))
+			break
+		}
+	}
+	if !isValidSignature {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil
+	}
+	if time.Now().Unix() >= claims.Expires || !isValidUsername(claims.Username) {
+		return nil
+	}
+	return &claims
+}
+
+func signedTokenAuthorization(token string) *Authorization {
+	claims := verifySignedToken(token)
+	if claims == nil || isSignedTokenRevoked(claims) {
+		return nil
+	}
+	scopes, err := parseScopes(claims.Scope)
+	if err != nil {
+		return nil
+	}
+	return &Authorization{claims.Username, claims.ClientId, scopes, token}
+}
+
+/* ---- Revocation ---- */
+
+// The revocation list of a user contains the ids of revoked tokens (until they expire anyway)
+// and the time, before which all tokens of the user were revoked (e.g. after a password change).
+type revokedTokens struct {
+	// in unix nanoseconds
+	RevokedBefore int64            `json:"revokedBefore"`
+	// token id -> expiry in unix seconds
+	Tokens        map[string]int64 `json:"tokens"`
+}
+
+type cachedRevokedTokens struct {
+	modTime time.Time
+	size    int64
+	revoked revokedTokens
+}
+
+// the revocation lists are read again, when they change (maybe by another server)
+var revokedTokensCache = make(map[string]*cachedRevokedTokens)
+var revokedTokensMutex sync.Mutex
+
+func readRevokedTokens(username string) (revokedTokens, error) {
+	filename := userGorsDir(username) + REVOKED_TOKENS_FILE_NAME
+	revoked := revokedTokens{Tokens: map[string]int64{}}
+	fileInfo, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		delete(revokedTokensCache, username)
+		return revoked, nil
+	} else if err != nil {
+		return revoked, err
+	}
+	cached := revokedTokensCache[username]
+	if cached != nil && cached.modTime.Equal(fileInfo.ModTime()) && cached.size == fileInfo.Size() {
+		return cached.revoked, nil
+	}
+	revokedJson, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return revoked, err
+	}
+	if err := json.Unmarshal(revokedJson, &revoked); err != nil {
+		return revoked, err
+	}
+	if revoked.Tokens == nil {
+		revoked.Tokens = map[string]int64{}
+	}
+	revokedTokensCache[username] = &cachedRevokedTokens{fileInfo.ModTime(), fileInfo.Size(), revoked}
+	return revoked, nil
+}
+
+func isSignedTokenRevoked(claims *tokenClaims) bool {
+	revokedTokensMutex.Lock()
+	defer revokedTokensMutex.Unlock()
+	revoked, err := readRevokedTokens(claims.Username)
+	if err != nil {
+		// better safe than sorry
+		fmt.Println("Error", err)
+		return true
+	}
+	_, isRevoked := revoked.Tokens[claims.Id]
+	return isRevoked || claims.IssuedAt <= revoked.RevokedBefore
+}
+
+// updateRevokedTokens changes the revocation list of the user and removes the ids of expired tokens.
+func updateRevokedTokens(username string, update func(*revokedTokens)) error {
+	revokedTokensMutex.Lock()
+	defer revokedTokensMutex.Unlock()
+	revoked, err := readRevokedTokens(username)
+	if err != nil {
+		return err
+	}
+	// copy, because the cached map must not change
+	tokens := map[string]int64{}
+	now := time.Now().Unix()
+	for id, expires := range revoked.Tokens {
+		if now < expires {
+			tokens[id] = expires
+		}
+	}
+	revoked.Tokens = tokens
+	update(&revoked)
+
+	revokedJson, err := json.Marshal(revoked)
+	if err != nil {
+		return err
+	}
+	ensureUserGorsDir(username)
+	filename := userGorsDir(username) + REVOKED_TOKENS_FILE_NAME
+	if err := ioutil.WriteFile(filename, revokedJson, 0600); err != nil {
+		return err
+	}
+	chownIfNeeded(filename, username)
+	delete(revokedTokensCache, username)
+	return nil
+}
+
+func revokeSignedToken(claims *tokenClaims) error {
+	return updateRevokedTokens(claims.Username, func(revoked *revokedTokens) {
+		revoked.Tokens[claims.Id] = claims.Expires
+	})
+}
+
+// revokeSignedTokens revokes all signed tokens of the user, which were issued until now.
+func revokeSignedTokens(username string) error {
+	return updateRevokedTokens(username, func(revoked *revokedTokens) {
+		revoked.RevokedBefore = time.Now().UnixNano()
+	})
+}
+
+// handleRevoke revokes a token (https://tools.ietf.org/html/rfc7009), so apps can log out.
+func handleRevoke(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	w.Header().Set("access-control-allow-methods", "POST")
+
+	if (r.Method == "OPTIONS") {
+		return;
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	r.ParseForm()
+	token := r.PostForm.Get("token")
+	if claims := verifySignedToken(token); claims != nil {
+		if err := revokeSignedToken(claims); err != nil {
+			fmt.Println("Error", err)
+			w.WriteHeader(503)
+			return
+		}
+	} else {
+		removeAuthorization(token)
+	}
+	// invalid tokens are no error (https://tools.ietf.org/html/rfc7009#section-2.2)
+	w.WriteHeader(200)
+}
@@ -0,0 +1,139 @@
+package gors
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"libs/assrt"
+)
+
+func withSignedTokens(t *testing.T, keys string) func() {
+	done := withUser1(t)
+	keysFile := dataPath + "/token-keys.txt"
+	ioutil.WriteFile(keysFile, []byte(keys), 0600)
+	if err := configureSignedTokens(Config{SignedTokens: true, TokenKeysFile: keysFile}); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		configureSignedTokens(Config{})
+		done()
+	}
+}
+
+func TestSignedTokens(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withSignedTokens(t, "# keys\nkey2 0123456789abcdef-new\nkey1 0123456789abcdef-old\n")
+	defer done()
+
+	tokens := len(authorizationByTokenHash)
+	authorization := newAuthorization("user1", "example.com", []Scope{Scope{"module", true}})
+	assert.True(strings.HasPrefix(authorization.bearerToken, "v1.key2."), authorization.bearerToken)
+	assert.Equal(tokens, len(authorizationByTokenHash))
+
+	verified := lookupAuthorization(authorization.bearerToken)
+	assert.MustNotNil(verified)
+	assert.Equal("user1", verified.username)
+	assert.Equal("example.com", verified.clientId)
+	assert.Equal([]Scope{Scope{"module", true}}, verified.scopes)
+
+	w := httptest.NewRecorder()
+	handleStorage(w, requestWithToken("PUT", STORAGE_PATH + "user1/module/file.txt", "text", authorization.bearerToken))
+	assert.Equal(200, w.Code)
+	w = httptest.NewRecorder()
+	handleStorage(w, requestWithToken("PUT", STORAGE_PATH + "user1/other/file.txt", "text", authorization.bearerToken))
+	assert.Equal(403, w.Code)
+
+	parts := strings.Split(authorization.bearerToken, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	forgedPayload := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(payload), "module:rw", "*:rw", 1)))
+	invalidTokens := []string{
+		"",
+		"v1",
+		authorization.bearerToken + "x",
+		strings.Join([]string{parts[0], parts[1], forgedPayload, parts[3]}, "."),
+		strings.Join([]string{parts[0], "key1", parts[2], parts[3]}, "."),
+		strings.Join([]string{parts[0], "key3", parts[2], parts[3]}, "."),
+		strings.Join([]string{"v2", parts[1], parts[2], parts[3]}, "."),
+	}
+	for _, token := range invalidTokens {
+		assert.Nil(lookupAuthorization(token), token)
+	}
+}
+
+func TestSignedTokenKeyRotation(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withSignedTokens(t, "key1 0123456789abcdef-old\n")
+	defer done()
+	oldToken := newAuthorization("user1", "example.com", []Scope{Scope{"module", true}}).bearerToken
+
+	keysFile := dataPath + "/token-keys.txt"
+	ioutil.WriteFile(keysFile, []byte("key2 0123456789abcdef-new\nkey1 0123456789abcdef-old\n"), 0600)
+	assert.MustNil(configureSignedTokens(Config{SignedTokens: true, TokenKeysFile: keysFile}))
+	newToken := newAuthorization("user1", "example.com", []Scope{Scope{"module", true}}).bearerToken
+	assert.True(strings.HasPrefix(newToken, "v1.key2."))
+	assert.NotNil(lookupAuthorization(oldToken))
+	assert.NotNil(lookupAuthorization(newToken))
+
+	ioutil.WriteFile(keysFile, []byte("key2 0123456789abcdef-new\n"), 0600)
+	assert.MustNil(configureSignedTokens(Config{SignedTokens: true, TokenKeysFile: keysFile}))
+	assert.Nil(lookupAuthorization(oldToken))
+	assert.NotNil(lookupAuthorization(newToken))
+}
+
+func TestSignedTokenExpiry(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withSignedTokens(t, "key1 0123456789abcdef-old\n")
+	defer done()
+
+	tokenLifetime = -time.Second
+	assert.Nil(lookupAuthorization(newAuthorization("user1", "example.com", []Scope{Scope{"module", true}}).bearerToken))
+}
+
+func TestSignedTokenRevocation(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withSignedTokens(t, "key1 0123456789abcdef-old\n")
+	defer done()
+	token1 := newAuthorization("user1", "example.com", []Scope{Scope{"module", true}}).bearerToken
+	token2 := newAuthorization("user1", "example.com", []Scope{Scope{"module", true}}).bearerToken
+
+	w := postForm(handleRevoke, REVOKE_PATH, url.Values{"token": {token1}}, nil)
+	assert.Equal(200, w.Code)
+	assert.Nil(lookupAuthorization(token1))
+	assert.NotNil(lookupAuthorization(token2))
+	w = postForm(handleRevoke, REVOKE_PATH, url.Values{"token": {"invalid"}}, nil)
+	assert.Equal(200, w.Code)
+
+	assert.MustNil(revokeAuthorizations("user1"))
+	assert.Nil(lookupAuthorization(token1))
+	assert.Nil(lookupAuthorization(token2))
+	assert.NotNil(lookupAuthorization(newAuthorization("user1", "example.com", []Scope{Scope{"module", true}}).bearerToken))
+
+	// the revocation list is shared by the servers, which use the same storage
+	revokedTokensCache = make(map[string]*cachedRevokedTokens)
+	assert.Nil(lookupAuthorization(token2))
+}
+
+func TestSignedTokenConfig(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withUser1(t)
+	defer done()
+	defer configureSignedTokens(Config{})
+
+	assert.NotNil(configureSignedTokens(Config{SignedTokens: true}))
+	assert.NotNil(configureSignedTokens(Config{SignedTokens: true, TokenKeysFile: dataPath + "/missing.txt"}))
+	keysFile := dataPath + "/token-keys.txt"
+	for _, keys := range []string{"", "key1\n", "key1 short\n", "key.1 0123456789abcdef\n"} {
+		ioutil.WriteFile(keysFile, []byte(keys), 0600)
+		assert.NotNil(configureSignedTokens(Config{SignedTokens: true, TokenKeysFile: keysFile}), keys)
+	}
+
+	oldServerSecret := serverSecret
+	defer func() { serverSecret = oldServerSecret }()
+	serverSecret = []byte("server secret")
+	assert.MustNil(configureSignedTokens(Config{SignedTokens: true}))
+	assert.True(strings.HasPrefix(newSignedToken("user1", "example.com", nil), "v1." + SERVER_SECRET_KEY_ID + "."))
+}
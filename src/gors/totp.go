@@ -0,0 +1,253 @@
+package gors
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ------------------------------------ Two-Factor Authentication ----------------------------- */
+
+// Users can enrol a TOTP secret (RFC 6238) on their dashboard. Afterwards they need a one-time
+// code of their authenticator app (or one of the recovery codes, each usable only once) in addition
+// to the password. The secret and the hashed recovery codes are stored in the .gors folder of the user.
+
+const TWO_FACTOR_FILE_NAME = "totp.json"
+
+const (
+	TOTP_DIGITS    = 6
+	TOTP_STEP      = 30 * time.Second
+	// accepted time steps before and after the current one, because clocks are never exact
+	TOTP_TOLERANCE = 1
+)
+
+// After too many wrong codes in a row the second factor of the user is locked for a while,
+// because a code has only 10^TOTP_DIGITS possible values. Share passwords are limited the same way.
+const (
+	MAX_FAILED_ATTEMPTS = 5
+	LOCKOUT_DURATION    = 5 * time.Minute
+)
+
+const RECOVERY_CODE_COUNT = 10
+
+type twoFactorSettings struct {
+	Secret        string   `json:"secret"`
+	RecoveryCodes []string `json:"recoveryCodes"`
+	// the last accepted time step, so a code can't be used twice
+	LastStep      int64    `json:"lastStep"`
+	attemptLimit
+}
+
+// attemptLimit counts the wrong attempts since the last valid one and stores the end of the lockout (in unix seconds).
+type attemptLimit struct {
+	FailedAttempts int   `json:"failedAttempts,omitempty"`
+	LockedUntil    int64 `json:"lockedUntil,omitempty"`
+}
+
+func (limit *attemptLimit) isLocked(now time.Time) bool {
+	return now.Unix() < limit.LockedUntil
+}
+
+func (limit *attemptLimit) addSuccess() {
+	limit.FailedAttempts = 0
+}
+
+// addFailure counts a wrong attempt and starts the lockout after too many of them.
+func (limit *attemptLimit) addFailure(now time.Time) {
+	limit.FailedAttempts++
+	if limit.FailedAttempts >= MAX_FAILED_ATTEMPTS {
+		limit.FailedAttempts = 0
+		limit.LockedUntil = now.Add(LOCKOUT_DURATION).Unix()
+	}
+}
+
+var twoFactorMutex sync.Mutex
+
+func twoFactorFilename(username string) string {
+	return userGorsDir(username) + TWO_FACTOR_FILE_NAME
+}
+
+func readTwoFactorSettings(username string) (*twoFactorSettings, error) {
+	content, err := ioutil.ReadFile(twoFactorFilename(username))
+	if err != nil {
+		return nil, err
+	}
+	var settings twoFactorSettings
+	if err := json.Unmarshal(content, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func writeTwoFactorSettings(username string, settings *twoFactorSettings) error {
+	content, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := twoFactorFilename(username)
+	if err := ioutil.WriteFile(filename, content, 0600); err != nil {
+		return err
+	}
+	chownIfNeeded(filename, username)
+	return nil
+}
+
+func hasTwoFactor(username string) bool {
+	existSettings, _ := exists(twoFactorFilename(username))
+	return existSettings
+}
+
+// isSecondFactorLocked checks if the second factor of the user is locked after too many wrong codes.
+func isSecondFactorLocked(username string) bool {
+	twoFactorMutex.Lock()
+	defer twoFactorMutex.Unlock()
+	settings, err := readTwoFactorSettings(username)
+	return err == nil && settings.isLocked(time.Now())
+}
+
+// isSecondFactorValid checks a one-time code or recovery code of the user and marks it as used.
+// No code is valid while the second factor is locked.
+func isSecondFactorValid(username string, code string) bool {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if code == "" {
+		return false
+	}
+	twoFactorMutex.Lock()
+	defer twoFactorMutex.Unlock()
+	settings, err := readTwoFactorSettings(username)
+	if err != nil {
+		fmt.Println("Error", err)
+		return false
+	}
+	now := time.Now()
+	if settings.isLocked(now) {
+		return false
+	}
+
+	if step, isValid := validateTotp(settings.Secret, code, now); isValid && step > settings.LastStep {
+		settings.LastStep = step
+		settings.addSuccess()
+		if err := writeTwoFactorSettings(username, settings); err != nil {
+			fmt.Println("Error", err)
+			return false
+		}
+		return true
+	}
+
+	hashedCode := sha512Sum(strings.ToLower(code))
+	for i, recoveryCode := range settings.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(recoveryCode), []byte(hashedCode)) == 1 {
+			settings.RecoveryCodes = append(settings.RecoveryCodes[:i], settings.RecoveryCodes[i+1:]...)
+			settings.addSuccess()
+			if err := writeTwoFactorSettings(username, settings); err != nil {
+				fmt.Println("Error", err)
+				return false
+			}
+			return true
+		}
+	}
+
+	settings.addFailure(now)
+	if err := writeTwoFactorSettings(username, settings); err != nil {
+		fmt.Println("Error", err)
+	}
+	return false
+}
+
+// enableTwoFactor stores the secret, if the code matches it, and returns new recovery codes.
+// An enabled second factor can't be replaced, it must be disabled (with a valid code) first.
+func enableTwoFactor(username string, secret string, code string) ([]string, error) {
+	step, isValid := validateTotp(secret, strings.TrimSpace(code), time.Now())
+	if !isValid {
+		return nil, errors.New("Wrong one-time code")
+	}
+	recoveryCodes := make([]string, RECOVERY_CODE_COUNT)
+	hashedRecoveryCodes := make([]string, RECOVERY_CODE_COUNT)
+	for i := range recoveryCodes {
+		recoveryCodes[i] = hex.EncodeToString(randomBytes(5))
+		hashedRecoveryCodes[i] = sha512Sum(recoveryCodes[i])
+	}
+	twoFactorMutex.Lock()
+	defer twoFactorMutex.Unlock()
+	if hasTwoFactor(username) {
+		return nil, errors.New("Two-factor authentication is already enabled")
+	}
+	return recoveryCodes, writeTwoFactorSettings(username, &twoFactorSettings{Secret: secret, RecoveryCodes: hashedRecoveryCodes, LastStep: step})
+}
+
+func disableTwoFactor(username string) error {
+	twoFactorMutex.Lock()
+	defer twoFactorMutex.Unlock()
+	err := os.Remove(twoFactorFilename(username))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ResetTwoFactor disables the two-factor authentication of a user, who lost the authenticator and the recovery codes.
+func ResetTwoFactor(config Config, username string) error {
+	configure(config)
+	if !isValidUsername(username) {
+		return errors.New("Invalid username: " + username)
+	}
+	if !hasTwoFactor(username) {
+		return errors.New(username + " has no two-factor authentication")
+	}
+	return disableTwoFactor(username)
+}
+
+func newTotpSecret() string {
+	return base32.StdEncoding.EncodeToString(randomBytes(20))
+}
+
+// totpUri returns the URI for authenticator apps (usually shown as QR code).
+func totpUri(issuer string, username string, secret string) string {
+	return "otpauth://totp/" + url.PathEscape(issuer + ":" + username) + "?" + url.Values{
+		"secret": {secret},
+		"issuer": {issuer},
+	}.Encode()
+}
+
+// validateTotp checks the code against the time steps around the time and returns the matching step.
+func validateTotp(secret string, code string, now time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	currentStep := now.Unix() / int64(TOTP_STEP / time.Second)
+	for step := currentStep - TOTP_TOLERANCE; step <= currentStep + TOTP_TOLERANCE; step++ {
+		if subtle.ConstantTimeCompare([]byte(totp(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totp computes the one-time code of a time step (RFC 4226 with the step as counter).
+func totp(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum) - 1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset + 4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value % modulus)
+}
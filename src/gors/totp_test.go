@@ -0,0 +1,128 @@
+package gors
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"libs/assrt"
+)
+
+func TestTotp(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	// test vectors of RFC 6238 (SHA1), shortened to 6 digits
+	key := []byte("12345678901234567890")
+	assert.Equal("287082", totp(key, 59 / 30))
+	assert.Equal("081804", totp(key, 1111111109 / 30))
+	assert.Equal("050471", totp(key, 1111111111 / 30))
+	assert.Equal("005924", totp(key, 1234567890 / 30))
+
+	secret := base32.StdEncoding.EncodeToString(key)
+	now := time.Unix(1111111109, 0)
+	step, isValid := validateTotp(secret, "081804", now)
+	assert.True(isValid)
+	assert.Equal(int64(1111111109 / 30), step)
+	_, isValid = validateTotp(secret, "081804", now.Add(TOTP_STEP))
+	assert.True(isValid)
+	_, isValid = validateTotp(secret, "081804", now.Add(2 * TOTP_STEP))
+	assert.True(!isValid)
+	_, isValid = validateTotp(secret, "81804", now)
+	assert.True(!isValid)
+	_, isValid = validateTotp("not base32!", "081804", now)
+	assert.True(!isValid)
+}
+
+func currentTotp(secret string) string {
+	key, _ := base32.StdEncoding.DecodeString(secret)
+	return totp(key, time.Now().Unix() / int64(TOTP_STEP / time.Second))
+}
+
+func TestSecondFactor(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+
+	secret := newTotpSecret()
+	_, err := enableTwoFactor("user1", secret, "000000x")
+	assert.NotNil(err)
+	assert.True(!hasTwoFactor("user1"))
+
+	code := currentTotp(secret)
+	recoveryCodes, err := enableTwoFactor("user1", secret, code)
+	assert.MustNil(err)
+	assert.Equal(RECOVERY_CODE_COUNT, len(recoveryCodes))
+	assert.True(hasTwoFactor("user1"))
+
+	// the code used for enrolment can't be used again
+	assert.True(!isSecondFactorValid("user1", code))
+	assert.True(!isSecondFactorValid("user1", ""))
+	assert.True(!isSecondFactorValid("user1", "123456"))
+
+	assert.True(isSecondFactorValid("user1", " " + strings.ToUpper(recoveryCodes[3]) + " "))
+	assert.True(!isSecondFactorValid("user1", recoveryCodes[3]))
+	assert.True(isSecondFactorValid("user1", recoveryCodes[4]))
+
+	config := Config{StorageDir: dataPath, StorageMode: HOME, ResourcesPath: ".."}
+	assert.MustNil(ResetTwoFactor(config, "user1"))
+	assert.True(!hasTwoFactor("user1"))
+	assert.NotNil(ResetTwoFactor(config, "user1"))
+	assert.NotNil(ResetTwoFactor(config, "../user1"))
+}
+
+func TestSecondFactorLockout(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+	secret := newTotpSecret()
+	recoveryCodes, err := enableTwoFactor("user1", secret, currentTotp(secret))
+	assert.MustNil(err)
+
+	for i := 0; i < MAX_FAILED_ATTEMPTS - 1; i++ {
+		assert.True(!isSecondFactorValid("user1", "wrong"))
+	}
+	assert.True(!isSecondFactorLocked("user1"))
+	// a valid code starts counting again
+	assert.True(isSecondFactorValid("user1", recoveryCodes[0]))
+	for i := 0; i < MAX_FAILED_ATTEMPTS; i++ {
+		assert.True(!isSecondFactorValid("user1", "wrong"))
+	}
+	assert.True(isSecondFactorLocked("user1"))
+	assert.True(!isSecondFactorValid("user1", recoveryCodes[1]))
+	assert.True(strings.Contains(checkLogin("user1", "password", recoveryCodes[1]), "Too many wrong one-time codes"))
+
+	settings, _ := readTwoFactorSettings("user1")
+	settings.LockedUntil = time.Now().Unix() - 1
+	writeTwoFactorSettings("user1", settings)
+	assert.True(!isSecondFactorLocked("user1"))
+	assert.True(isSecondFactorValid("user1", recoveryCodes[1]))
+}
+
+func TestAuthWithSecondFactor(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	done := withAuthUser1(t)
+	defer done()
+	secret := newTotpSecret()
+	recoveryCodes, err := enableTwoFactor("user1", secret, currentTotp(secret))
+	assert.MustNil(err)
+
+	w := auth("GET", AUTH_PATH + "user1" + AUTH_QUERY, "")
+	assert.True(strings.Contains(w.Body.String(), `name="otp"`))
+	match := CSRF_TOKEN_INPUT_PATTERN.FindStringSubmatch(w.Body.String())
+	assert.MustNotNil(match)
+	cookies := w.Result().Cookies()
+	post := func(password string, otp string) string {
+		form := url.Values{"password": {password}, "otp": {otp}, CSRF_TOKEN_FIELD: {match[1]}}
+		w := postAuthForm(AUTH_PATH + "user1" + AUTH_QUERY, form, cookies)
+		if w.Code == 303 {
+			return w.Header().Get("Location")
+		}
+		return w.Body.String()
+	}
+
+	assert.True(strings.Contains(post("password", ""), "Wrong one-time code"))
+	assert.True(strings.Contains(post("password", "123456"), "Wrong one-time code"))
+	// recovery codes are not used up by wrong passwords
+	assert.True(strings.Contains(post("wrong", recoveryCodes[0]), "Wrong Password"))
+	assert.True(strings.HasPrefix(post("password", recoveryCodes[0]), "https://app.example.com/#access_token="))
+}
@@ -3,15 +3,77 @@ package main
 import (
 	"gors"
 	"flag"
+	"fmt"
+	"log"
 )
 
 func main() {
-	storageDir := flag.String("storage", "storage", "Storage Root Directory")
-	storageMode := flag.String("mode", gors.HOME, "Storage Mode")
-	chown := flag.String("chown", "", "Chown files to provided user name or use authenticated user name (*)")
-	resourcesPath := flag.String("resources", "src", "Path for templates and css")
-	port := flag.Int("port", 8888, "Server Port")
-	externalBaseUrl := flag.String("url", "", "External Base URL")
+	config := gors.Config{}
+	flag.StringVar(&config.StorageDir, "storage", "storage", "Storage Root Directory")
+	flag.StringVar((*string)(&config.StorageMode), "mode", gors.HOME, "Storage Mode")
+	flag.StringVar(&config.Chown, "chown", "", "Chown files to provided user name or use authenticated user name (*)")
+	flag.StringVar(&config.ResourcesPath, "resources", "src", "Path for templates and css")
+	flag.IntVar(&config.Port, "port", 8888, "Server Port")
+	flag.StringVar(&config.ExternalBaseUrl, "url", "", "External Base URL")
+	flag.StringVar(&config.Backend, "backend", gors.FILESYSTEM_BACKEND, "Where documents are stored (fs or s3)")
+	flag.StringVar(&config.S3.Endpoint, "s3-endpoint", "http://localhost:9000", "S3 Endpoint URL")
+	flag.StringVar(&config.S3.Region, "s3-region", "us-east-1", "S3 Region")
+	flag.StringVar(&config.S3.Bucket, "s3-bucket", "gors", "S3 Bucket")
+	flag.StringVar(&config.S3.AccessKey, "s3-access-key", "", "S3 Access Key")
+	flag.StringVar(&config.S3.SecretKey, "s3-secret-key", "", "S3 Secret Key")
+	flag.StringVar(&config.S3.Prefix, "s3-prefix", "", "Prefix for all S3 object keys")
+	flag.BoolVar(&config.Git, "git", false, "Commit every change to a git repository per user")
+	flag.StringVar(&config.SecretFile, "secret-file", "", "File containing the server secret")
+	flag.BoolVar(&config.Encrypt, "encrypt", false, "Encrypt stored documents (needs -secret-file)")
+	flag.StringVar(&config.Compression, "compress", "", "Store compressible documents compressed (gzip)")
+	flag.BoolVar(&config.Dedup, "dedup", false, "Store identical documents only once")
+	config.Domains = gors.Domains{}
+	flag.Var(config.Domains, "domain", "Served domain for webfinger, optionally with base URL (example.com=https://example.com), can be repeated")
+	flag.StringVar(&config.SpecVersion, "spec-version", "", "Advertise this remoteStorage spec version (like draft-dejong-remotestorage-02) in webfinger")
+	config.WebfingerProperties = gors.Properties{}
+	flag.Var(config.WebfingerProperties, "webfinger-property", "Additional property (key=value) of the remoteStorage webfinger link, can be repeated")
+	flag.BoolVar(&config.QueryTokens, "query-tokens", false, "Accept tokens in the access_token query parameter of GET requests")
+	flag.BoolVar(&config.AuthCodeFlow, "auth-code-flow", false, "Enable the OAuth authorization code flow with PKCE and the token endpoint")
+	flag.StringVar(&config.Authenticator, "auth", "file", "How passwords are checked: file (.gors/password-sha512.txt), ldap, htpasswd or owncloud")
+	flag.StringVar(&config.LDAP.Url, "ldap-url", "", "URL of the LDAP server (ldap://host:389 or ldaps://host:636)")
+	flag.StringVar(&config.LDAP.UserDN, "ldap-user-dn", "", "DN of users with %s for the username, like uid=%s,ou=people,dc=example,dc=com")
+	flag.StringVar(&config.HtpasswdFile, "htpasswd", "", "htpasswd file with bcrypt, SHA or MD5 (APR1) passwords for -auth htpasswd")
+	flag.StringVar(&config.OwnCloud.DBDriver, "owncloud-db-driver", "sqlite3", "SQL driver of the ownCloud database for -auth owncloud: sqlite3 or mysql")
+	flag.StringVar(&config.OwnCloud.DSN, "owncloud-db", "", "Data source name of the ownCloud database, like /var/www/owncloud/data/owncloud.db")
+	flag.StringVar(&config.OwnCloud.TablePrefix, "owncloud-table-prefix", "oc_", "Table prefix of the ownCloud database")
+	flag.StringVar(&config.OwnCloud.PasswordSalt, "owncloud-password-salt", "", "passwordsalt of the ownCloud config.php (for passwords of ownCloud versions before 8)")
+	flag.StringVar(&config.Registration.Mode, "registration", "", "Let new users sign up at /gors/register: open or invite (with an invitation code)")
+	flag.StringVar(&config.Registration.InvitationFile, "invitations", "", "File with one invitation code per line for -registration invite, used codes are removed")
+	flag.StringVar(&config.Registration.UsernamePattern, "username-pattern", gors.DEFAULT_USERNAME_PATTERN, "Regular expression for the usernames of new users")
+	flag.IntVar(&config.MinPasswordLength, "min-password-length", gors.DEFAULT_MIN_PASSWORD_LENGTH, "Minimal length of new passwords")
+	flag.BoolVar(&config.SignedTokens, "signed-tokens", false, "Issue stateless tokens signed with the keys of -token-keys (or the secret of -secret-file)")
+	flag.StringVar(&config.TokenKeysFile, "token-keys", "", "File with token signing keys, one \"<key id> <secret>\" per line, the first key signs")
+	flag.DurationVar(&config.TokenLifetime, "token-lifetime", gors.DEFAULT_TOKEN_LIFETIME, "Lifetime of signed tokens")
+	flag.IntVar(&config.TokenLength, "token-length", gors.DEFAULT_TOKEN_LENGTH, "Number of characters of random tokens (at least 20)")
+	resetTwoFactor := flag.String("reset-2fa", "", "Disable the two-factor authentication of this user and exit")
+	passwordResetLink := flag.String("password-reset-link", "", "Print a one-time link to reset the password of this user and exit")
+	encryptStorage := flag.Bool("encrypt-storage", false, "Encrypt all documents in the storage directory and exit")
+	decryptStorage := flag.Bool("decrypt-storage", false, "Decrypt all documents in the storage directory and exit")
 	flag.Parse()
-	gors.StartServer(*storageDir, gors.StorageMode(*storageMode), *chown, *resourcesPath, *port, *externalBaseUrl);
+	if *resetTwoFactor != "" {
+		if err := gors.ResetTwoFactor(config, *resetTwoFactor); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *passwordResetLink != "" {
+		link, err := gors.CreatePasswordResetLink(config, *passwordResetLink)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(link)
+		return
+	}
+	if *encryptStorage || *decryptStorage {
+		if err := gors.CryptStorage(config, *encryptStorage); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	gors.StartServer(config);
 }
@@ -0,0 +1,7 @@
+//go:build mysql
+// +build mysql
+
+package main
+
+// MySQL driver for -auth owncloud, build with: go build -tags mysql main
+import _ "libs/mysql"
@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// SQLite driver for -auth owncloud, build with: go build -tags sqlite main
+import _ "libs/sqlite3"
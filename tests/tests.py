@@ -25,44 +25,99 @@ def givenTestStorage():
 
 
 def test_get_webfinger():
-	request = urllib2.urlopen(server+"/.well-known/host-meta.json?resource=acct%3Ausername%40domain.net");
+	request = urllib2.urlopen(server+"/.well-known/host-meta.json?resource=acct%3Auser1%40domain.net");
 	response = request.read();
 	print response
 	print request.info()
 	resultJSON = json.loads(response)
 	link = resultJSON['links'][0]
-	assert link["href"] == server + "/gors/storage/username"
+	assert link["href"] == server + "/gors/storage/user1"
 	assert link["rel"] == "remoteStorage"
 	assert link["type"] == "https://www.w3.org/community/rww/wiki/read-write-web-00#simple"
 	props = link["properties"]
 	assert props["auth-method"] == "https://tools.ietf.org/html/draft-ietf-oauth-v2-26#section-4.2"
-	assert props["auth-endpoint"] == server + "/gors/auth/username"
+	assert props["auth-endpoint"] == server + "/gors/auth/user1"
 	assert request.info()['Content-Type'].startswith('application/json')
 	
+def test_get_webfinger_rfc7033():
+	request = urllib2.urlopen(server+"/.well-known/webfinger?resource=acct%3Auser1%40domain.net&rel=remoteStorage");
+	resultJSON = json.loads(request.read())
+	assert resultJSON['subject'] == "acct:user1@domain.net"
+	assert resultJSON['links'][0]["href"] == server + "/gors/storage/user1"
+	assert request.info()['Content-Type'].startswith('application/jrd+json')
+
+def test_get_webfinger_with_invalid_resource():
+	conn = getConnection()
+	conn.request("GET", "/.well-known/webfinger?resource=user1")
+	r = conn.getresponse()
+	assert r.status == 400
+	conn = getConnection()
+	conn.request("GET", "/.well-known/host-meta.json")
+	r = conn.getresponse()
+	assert r.status == 400
+
+def test_get_webfinger_for_unknown_user():
+	conn = getConnection()
+	conn.request("GET", "/.well-known/webfinger?resource=acct%3Aunknown%40domain.net")
+	r = conn.getresponse()
+	assert r.status == 404
+
 
 def test_auth_page():
-	request = urllib2.urlopen(server+"/gors/auth/marco"+"?redirect_uri=https%3A%2F%2Fmyfavoritedrinks.5apps.com%2F&client_id=myfavoritedrinks.5apps.com&scope=myfavoritedrinks%3Arw&response_type=token");
+	request = urllib2.urlopen(server+"/gors/auth/user1"+"?redirect_uri=https%3A%2F%2Fmyfavoritedrinks.5apps.com%2F&client_id=myfavoritedrinks.5apps.com&scope=myfavoritedrinks%3Arw&response_type=token");
 	response = request.read();
 	assert "<h1>Allow Remote Storage Access?</h1>" in response
-	assert "marco" in response
+	assert "user1" in response
 	assert "myfavoritedrinks" in response
 	assert "Full Access" in response
 	assert "myfavoritedrinks.5apps.com" in response
 
-def test_confirm_permission_with_password_and_redirect_to_app():
-	values = {'password' : 'password'}
-	data = urllib.urlencode(values)
-	headers = {"Content-type": "application/x-www-form-urlencoded",
-            "Accept": "text/plain"}	
+def test_auth_page_with_invalid_redirect_uri():
 	conn = getConnection()
-	conn.request("POST", "/gors/auth/user1"+"?redirect_uri=https%3A%2F%2Fmyfavoritedrinks.5apps.com%2F&client_id=myfavoritedrinks.5apps.com&scope=myfavoritedrinks%3Arw&response_type=token",data,headers)
+	conn.request("GET", "/gors/auth/user1?redirect_uri=javascript%3Aalert(1)&client_id=myfavoritedrinks.5apps.com&scope=myfavoritedrinks%3Arw")
+	r = conn.getresponse()
+	assert r.status == 400
+	assert r.getheader("Location") is None
+
+def test_auth_page_with_redirect_uri_of_other_app():
+	conn = getConnection()
+	conn.request("GET", "/gors/auth/user1?redirect_uri=https%3A%2F%2Fevil.example.com%2F&client_id=myfavoritedrinks.5apps.com&scope=myfavoritedrinks%3Arw")
 	r = conn.getresponse()
+	assert r.status == 400
+	assert r.getheader("Location") is None
+
+def test_auth_page_with_invalid_scope():
+	conn = getConnection()
+	conn.request("GET", "/gors/auth/user1?redirect_uri=https%3A%2F%2Fmyfavoritedrinks.5apps.com%2F&client_id=myfavoritedrinks.5apps.com&scope=myfavoritedrinks&state=42")
+	r = conn.getresponse()
+	assert r.status == 302
+	assert r.getheader("Location") == "https://myfavoritedrinks.5apps.com/#error=invalid_scope&state=42"
+
+def test_confirm_permission_with_password_and_redirect_to_app():
+	path = "/gors/auth/user1"+"?redirect_uri=https%3A%2F%2Fmyfavoritedrinks.5apps.com%2F&client_id=myfavoritedrinks.5apps.com&scope=myfavoritedrinks%3Arw&response_type=token"
+	r = postAuthForm(path, {'password' : 'password'})
 	print r.status, r.reason
+	assert r.status == 303
 	redirectUrl = r.getheader('Location')
 	expectedRedirectUrlPrefix = 'https://myfavoritedrinks.5apps.com/#access_token='
 	assert redirectUrl.startswith(expectedRedirectUrlPrefix)
 	assert len(redirectUrl[len(expectedRedirectUrlPrefix):])>=10
 
+def test_confirm_permission_needs_csrf_token():
+	data = urllib.urlencode({'password' : 'password'})
+	headers = {"Content-type": "application/x-www-form-urlencoded"}
+	conn = getConnection()
+	conn.request("POST", "/gors/auth/user1"+"?redirect_uri=https%3A%2F%2Fmyfavoritedrinks.5apps.com%2F&client_id=myfavoritedrinks.5apps.com&scope=myfavoritedrinks%3Arw&response_type=token",data,headers)
+	r = conn.getresponse()
+	assert r.status == 403
+	assert r.getheader('Location') is None
+
+def test_deny_permission_and_redirect_to_app():
+	path = "/gors/auth/user1"+"?redirect_uri=https%3A%2F%2Fmyfavoritedrinks.5apps.com%2F&client_id=myfavoritedrinks.5apps.com&scope=myfavoritedrinks%3Arw&state=42"
+	r = postAuthForm(path, {'deny' : 'Deny'})
+	assert r.status == 303
+	assert r.getheader('Location') == "https://myfavoritedrinks.5apps.com/#error=access_denied&state=42"
+
 def test_storage_cors():
 	conn = getConnection()
 	conn.request("OPTIONS", "/gors/storage/user1/myfavoritedrinks/")
@@ -92,7 +147,7 @@ def test_storage_directory_listing_needs_bearer_token_matching_scopes(givenTestS
 	bearerToken = requestBearerToken()
 	print("Bearer:"+bearerToken)
 	r = makeRequest("/storage/user1/other-module/",'GET',bearerToken)
-	assert r.status == 401;		
+	assert r.status == 403;		
 	r = makeRequest("/storage/user1/module/",'GET',bearerToken)
 	assert r.status == 200;
 	r = makeRequest("/storage/user1/public/module/",'GET',bearerToken)
@@ -130,9 +185,9 @@ def test_storage_prevent_attempt_to_hack_path(givenTestStorage):
 def test_storage_directory_listing_needs_bearer_token_matching_scope_mode(givenTestStorage):
 	bearerToken = requestBearerToken(scopes=['module:r'])
 	r = makeRequest("/storage/user1/module/new-file.txt",'PUT',bearerToken,"new text")	
-	assert r.status == 401;		
+	assert r.status == 403;		
 	r = makeRequest("/storage/user1/module/new-file.txt",'DELETE',bearerToken)	
-	assert r.status == 401;			
+	assert r.status == 403;			
 	
 
 def test_storage_directory_listing(givenTestStorage):
@@ -317,18 +372,26 @@ def getConnection():
 		return httplib.HTTPConnection(host+':'+port)
 
 def requestBearerToken(mode="rw",scopes=['module:rw']):
-	values = {'password' : 'password'}
-	data = urllib.urlencode(values)
-	headers = {"Content-type": "application/x-www-form-urlencoded"}	
-	conn = getConnection()
 	scopesString = "%20".join(scopes).replace(":","%3A")
-	conn.request("POST", "/gors/auth/"+username+"?redirect_uri=https%3A%2F%2Fmyfavoritedrinks.5apps.com%2F&client_id=myfavoritedrinks.5apps.com&scope="+scopesString+"&response_type=token",data,headers)
-	r = conn.getresponse()		
+	r = postAuthForm("/gors/auth/"+username+"?redirect_uri=https%3A%2F%2Fmyfavoritedrinks.5apps.com%2F&client_id=myfavoritedrinks.5apps.com&scope="+scopesString+"&response_type=token", {'password' : 'password'})
 	redirectUrl = r.getheader('Location')
 	expectedRedirectUrlPrefix = 'https://myfavoritedrinks.5apps.com/#access_token='
 	return redirectUrl[len(expectedRedirectUrlPrefix):]
 
 
+# posts the login form with the CSRF token and cookie of the form page
+def postAuthForm(path,values):
+	conn = getConnection()
+	conn.request("GET", path)
+	r = conn.getresponse()
+	cookie = r.getheader('Set-Cookie').split(";")[0]
+	values['csrf_token'] = re.search('name="csrf_token" value="([0-9a-f]+)"', r.read()).group(1)
+	headers = {"Content-type": "application/x-www-form-urlencoded", "Cookie": cookie}
+	conn = getConnection()
+	conn.request("POST", path, urllib.urlencode(values), headers)
+	return conn.getresponse()
+
+
 # headers = {} does not work because of http://stackoverflow.com/questions/1132941/least-astonishment-in-python-the-mutable-default-argument
 def makeRequest(path,method="GET",bearerToken=None,data="",contentType=None,headers=None):
 	conn = getConnection()